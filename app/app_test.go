@@ -0,0 +1,216 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+	"github.com/abhicnv007/messenger-server/storage"
+	"github.com/abhicnv007/messenger-server/storage/memory"
+)
+
+//srv serves every route on the memory backend. The hub, event log and
+//waiters are global, so all tests share one store and never reuse an id
+var srv *httptest.Server
+
+func TestMain(m *testing.M) {
+	storage.Use(memory.New())
+	//Every test signs up its own users from the same ip
+	loginRate, loginBurst = 1000, 1000
+	srv = httptest.NewServer(NewRouter())
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+var lastUser int64
+
+type testUser struct {
+	UID    int64
+	Name   string
+	Secret string
+}
+
+func (u testUser) href() string {
+	return userURI + "/" + strconv.FormatInt(u.UID, 10)
+}
+
+//newTestUser signs up a user with a unique name
+func newTestUser(t *testing.T) testUser {
+	t.Helper()
+
+	name := fmt.Sprintf("user%d", atomic.AddInt64(&lastUser, 1))
+	res, b := do(t, testUser{}, "POST", userURI, map[string]string{
+		"name": name, "password": "password",
+	})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Signing up %s: %d %s", name, res.StatusCode, b)
+	}
+
+	var ru response.User
+	decode(t, b, &ru)
+	uid, err := getIDFromLink(ru.Href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testUser{UID: uid, Name: name, Secret: ru.Secret}
+}
+
+//do sends the request as the user, or without authentication if it has no
+//uid, and returns the response with its body read
+func do(t *testing.T, u testUser, method string, path string, body interface{}) (*http.Response, []byte) {
+	t.Helper()
+
+	var rb []byte
+	if body != nil {
+		var err error
+		if rb, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(rb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UID != 0 {
+		req.SetBasicAuth(strconv.FormatInt(u.UID, 10), u.Secret)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b
+}
+
+//mustDo is do failing the test unless the response has the status
+func mustDo(t *testing.T, status int, u testUser, method string, path string, body interface{}) []byte {
+	t.Helper()
+	res, b := do(t, u, method, path, body)
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, path, res.StatusCode, status, b)
+	}
+	return b
+}
+
+func decode(t *testing.T, b []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("Decoding %s: %v", b, err)
+	}
+}
+
+func threadPath(tid int64) string {
+	return threadsURI + "/" + strconv.FormatInt(tid, 10)
+}
+
+func messagePath(tid int64, mid int64) string {
+	return threadPath(tid) + "/messages/" + strconv.FormatInt(mid, 10)
+}
+
+//newTestThread creates a thread of u with the others and returns its id
+func newTestThread(t *testing.T, u testUser, others ...testUser) int64 {
+	t.Helper()
+
+	rt := response.Thread{}
+	for _, o := range others {
+		rt.Participants = append(rt.Participants, response.Link{Href: o.href()})
+	}
+	var created response.Thread
+	decode(t, mustDo(t, http.StatusCreated, u, "POST", threadsURI, rt), &created)
+
+	tid, err := getIDFromLink(created.Href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tid
+}
+
+//testTime returns the time sec seconds after a fixed start, for messages
+func testTime(sec int) string {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return start.Add(time.Duration(sec) * time.Second).Format(time.RFC3339)
+}
+
+//postMessage sends a message as u and returns its id
+func postMessage(t *testing.T, u testUser, tid int64, content string, at string) int64 {
+	t.Helper()
+
+	mustDo(t, http.StatusCreated, u, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: content, Time: at})
+
+	for _, m := range getMessages(t, u, tid) {
+		if m.Content == content {
+			_, mid, err := getMessageIDsFromLink(m.Href)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return mid
+		}
+	}
+	t.Fatalf("Message %q not found after sending it", content)
+	return 0
+}
+
+func getMessages(t *testing.T, u testUser, tid int64) []response.Message {
+	t.Helper()
+	var rm []response.Message
+	decode(t, mustDo(t, http.StatusOK, u, "GET", threadPath(tid)+"/messages", nil), &rm)
+	return rm
+}
+
+func TestSignUpAndGetUser(t *testing.T) {
+	u := newTestUser(t)
+
+	var ru response.User
+	decode(t, mustDo(t, http.StatusOK, u, "GET", u.href(), nil), &ru)
+	if ru.Name != u.Name {
+		t.Errorf("Got name %q, want %q", ru.Name, u.Name)
+	}
+	if ru.Secret != "" {
+		t.Error("Secret sent with the user details")
+	}
+}
+
+func TestRequiresAuthentication(t *testing.T) {
+	u := newTestUser(t)
+
+	mustDo(t, http.StatusUnauthorized, testUser{}, "GET", threadsURI, nil)
+	mustDo(t, http.StatusUnauthorized, testUser{UID: u.UID, Secret: "wrong"}, "GET", threadsURI, nil)
+}
+
+func TestThreadMessages(t *testing.T) {
+	a, b, outsider := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	mid := postMessage(t, a, tid, "hello", testTime(1))
+	postMessage(t, b, tid, "hi", testTime(2))
+
+	//Latest first
+	ms := getMessages(t, b, tid)
+	if len(ms) != 2 || ms[0].Content != "hi" || ms[1].Content != "hello" {
+		t.Fatalf("Got messages %+v", ms)
+	}
+
+	var rm response.Message
+	decode(t, mustDo(t, http.StatusOK, b, "GET", messagePath(tid, mid), nil), &rm)
+	if rm.Content != "hello" || rm.From.Href != a.href() {
+		t.Errorf("Got message %+v", rm)
+	}
+
+	mustDo(t, http.StatusUnauthorized, outsider, "GET", threadPath(tid), nil)
+}
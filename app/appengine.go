@@ -0,0 +1,53 @@
+// +build appengine
+
+package app
+
+import (
+	"net/http"
+
+	"google.golang.org/appengine"
+
+	"github.com/abhicnv007/messenger-server/response"
+	"github.com/abhicnv007/messenger-server/storage"
+	"github.com/abhicnv007/messenger-server/storage/datastore"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//On App Engine the routes are served by the runtime from the default mux,
+//everything else builds its own server around NewRouter
+func init() {
+	newContext = appengine.NewContext
+	storage.Use(datastore.New())
+
+	//Restricted to admins of the project in app.yaml
+	http.HandleFunc("/admin/migrate-passwords", migratePasswords)
+
+	http.Handle("/", NewRouter())
+}
+
+/*
+migratePasswords hashes every legacy plaintext password in the Datastore, it
+only has to be run once after deploying the version that hashes passwords
+
+Request: POST at "/admin/migrate-passwords" while logged in as an admin
+
+Response: a JSON object with the number of users whose password got hashed
+*/
+func migratePasswords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		response.New(w).WithCode(http.StatusMethodNotAllowed).
+			Error("Only POST is allowed")
+		return
+	}
+
+	n, err := user.MigratePasswords(newContext(r))
+	if err != nil {
+		response.New(w).WithCode(http.StatusInternalServerError).
+			Error("Migration stopped: " + err.Error())
+		return
+	}
+
+	response.New(w).WithCode(http.StatusOK).WithData(struct {
+		Migrated int `json:"migrated"`
+	}{n})
+}
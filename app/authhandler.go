@@ -5,32 +5,42 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
-	gorillacon "github.com/gorilla/context"
-
+	"github.com/abhicnv007/messenger-server/auth"
+	"github.com/abhicnv007/messenger-server/handler"
+	"github.com/abhicnv007/messenger-server/response"
 	"github.com/abhicnv007/messenger-server/user"
-	"google.golang.org/appengine"
 )
 
-func getUIDContext(r *http.Request) int64 {
-	return gorillacon.Get(r, "UID").(int64)
-}
-
-func setUIDContext(r *http.Request, val int64) {
-	gorillacon.Set(r, "UID", val)
+//getPrincipal returns who the request is authenticated as. If it is not, like
+//on a route registered with NoAuth, it responds with StatusUnauthorized and
+//ok is false
+func getPrincipal(w http.ResponseWriter, r *http.Request) (p auth.Principal, ok bool) {
+	if p, ok = auth.FromContext(r.Context()); !ok {
+		response.New(w).WithCode(http.StatusUnauthorized).
+			Error("Not authenticated")
+	}
+	return p, ok
 }
 
 /*
-	Checks the BasicAuth of the request and if not found, returns error
+	Checks the BasicAuth or the Bearer token of the request and if not found,
+	returns error
 
-	Expected input: base64 encoded `{uid} : {secret}` in Authorization Header
+	Expected input: base64 encoded `{uid} : {secret}` in Authorization Header,
+	or `Bearer {access token}` if access tokens are enabled
 */
-func authFn(w http.ResponseWriter, r *http.Request) error {
+func authFn(w http.ResponseWriter, r *http.Request) (auth.Principal, error) {
+
+	if tok, ok := handler.BearerToken(r); ok {
+		return bearerAuth(r, tok)
+	}
 
 	u, secret, ok := r.BasicAuth()
 	if ok != true {
 		//w.Header().Add("WWW-Authenticate", "Basic realm=\"Whistle Api\"")
-		return errors.New("Basic Auth")
+		return auth.Principal{}, errors.New("Basic Auth")
 	}
 
 	//BasicAuth returns uid and secret as strings, so parse them
@@ -38,16 +48,39 @@ func authFn(w http.ResponseWriter, r *http.Request) error {
 
 	if err != nil {
 		log.Println("Could not parse the uid in auth handler", err)
-		return errors.New("Invalid uid")
+		return auth.Principal{}, errors.New("Invalid uid")
 	}
 
-	c := appengine.NewContext(r)
-	_, err = user.IsValidSecret(c, uid, secret)
+	c := newContext(r)
+	_, cr, err := user.IsValidSecret(c, uid, secret)
 	if err != nil {
-		return err
+		return auth.Principal{}, err
 	}
 
-	setUIDContext(r, uid)
+	return auth.Principal{
+		UID:          uid,
+		CredentialID: cr.CredentialID,
+		Scopes:       []string{auth.ScopeAll},
+		Method:       auth.MethodBasic,
+	}, nil
+}
+
+//bearerAuth checks the access token, it is self contained so the storage
+//backend is not hit
+func bearerAuth(r *http.Request, tok string) (auth.Principal, error) {
+	if keyring == nil {
+		return auth.Principal{}, errors.New("Bearer Auth is not enabled")
+	}
+
+	cl, err := keyring.Verify(tok, time.Now())
+	if err != nil {
+		return auth.Principal{}, err
+	}
 
-	return nil
+	return auth.Principal{
+		UID:          cl.UID,
+		CredentialID: cl.CredentialID,
+		Scopes:       []string{auth.ScopeAll},
+		Method:       auth.MethodBearer,
+	}, nil
 }
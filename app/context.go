@@ -0,0 +1,21 @@
+package app
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+//newContext returns the context handlers pass on to the storage backend, it
+//is appengine.NewContext when deployed to App Engine
+var newContext = requestContext
+
+func requestContext(r *http.Request) context.Context {
+	return r.Context()
+}
+
+//SetContextFunc replaces how the context handed to the storage backend is
+//built from a request, by default it is the context of the request itself
+func SetContextFunc(fn func(r *http.Request) context.Context) {
+	newContext = fn
+}
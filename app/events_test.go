@@ -0,0 +1,179 @@
+package app
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/live"
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+//eventStream reads the Server-Sent Events of a user
+type eventStream struct {
+	res    *http.Response
+	events chan live.Event
+}
+
+//openEvents connects to /events as the user, resuming after lastID if set
+func openEvents(t *testing.T, u testUser, lastID string) *eventStream {
+	t.Helper()
+	return openEventsAt(t, u, eventsURI, lastID)
+}
+
+//openEventsAt is openEvents with the query of the path
+func openEventsAt(t *testing.T, u testUser, path string, lastID string) *eventStream {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(strconv.FormatInt(u.UID, 10), u.Secret)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		t.Fatalf("Opening the events: %d", res.StatusCode)
+	}
+
+	s := &eventStream{res: res, events: make(chan live.Event, 64)}
+	go func() {
+		defer close(s.events)
+		r := bufio.NewReader(res.Body)
+		var e live.Event
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			l = strings.TrimSuffix(l, "\n")
+			switch {
+			case l == "":
+				if e.Type != "" {
+					s.events <- e
+				}
+				e = live.Event{}
+			case strings.HasPrefix(l, "id: "):
+				e.ID = strings.TrimPrefix(l, "id: ")
+			case strings.HasPrefix(l, "event: "):
+				e.Type = strings.TrimPrefix(l, "event: ")
+			case strings.HasPrefix(l, "data: "):
+				e.Data = []byte(strings.TrimPrefix(l, "data: "))
+			}
+		}
+	}()
+	return s
+}
+
+//next returns the next event of the type, skipping the others
+func (s *eventStream) next(t *testing.T, typ string) live.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				t.Fatalf("Stream closed waiting for a %s event", typ)
+			}
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %s event", typ)
+		}
+	}
+}
+
+//none fails if an event of the type comes within d
+func (s *eventStream) none(t *testing.T, typ string, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			if e.Type == typ {
+				t.Fatalf("Got an unexpected %s event %s", typ, e.Data)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (s *eventStream) close() {
+	s.res.Body.Close()
+}
+
+func TestEventsResume(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	s := openEvents(t, b, "")
+	postMessage(t, a, tid, "first", testTime(1))
+	first := s.next(t, eventNewMessage)
+	if first.ID == "" || !strings.Contains(string(first.Data), "first") {
+		t.Fatalf("Got %+v", first)
+	}
+	s.close()
+
+	//Missed while disconnected
+	postMessage(t, a, tid, "second", testTime(2))
+
+	s = openEvents(t, b, first.ID)
+	defer s.close()
+	second := s.next(t, eventNewMessage)
+	if !strings.Contains(string(second.Data), "second") {
+		t.Fatalf("Resumed with %s, want the missed message", second.Data)
+	}
+
+	//Or from the query, as browsers cannot set headers on an EventSource
+	q := openEventsAt(t, b, eventsURI+"?lastEventId="+first.ID, "")
+	defer q.close()
+	if e := q.next(t, eventNewMessage); !strings.Contains(string(e.Data), "second") {
+		t.Errorf("Resumed from the query with %s, want the missed message", e.Data)
+	}
+
+	//An id of another run of the server can not be resumed from
+	r := openEvents(t, b, "gone-1")
+	defer r.close()
+	r.next(t, eventReset)
+}
+
+func TestEventsRedactDeleted(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	s := openEvents(t, b, "")
+	postMessage(t, a, tid, "before", testTime(1))
+	before := s.next(t, eventNewMessage)
+	s.close()
+
+	mid := postMessage(t, a, tid, "secret", testTime(2))
+	mustDo(t, http.StatusCreated, b, "POST", threadPath(tid)+"/messages", response.Message{
+		Content: "quoting",
+		Time:    testTime(3),
+		ReplyTo: &response.Quote{Link: response.Link{Href: messagePath(tid, mid)}},
+	})
+	mustDo(t, http.StatusNoContent, a, "DELETE", messagePath(tid, mid)+"?for=everyone", nil)
+
+	s = openEvents(t, b, before.ID)
+	defer s.close()
+	for _, want := range []string{eventNewMessage, eventNewMessage, eventMessageDeleted} {
+		e := s.next(t, want)
+		if strings.Contains(string(e.Data), "secret") {
+			t.Errorf("Resumed with the deleted content in %s %s", e.Type, e.Data)
+		}
+	}
+}
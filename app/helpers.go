@@ -17,14 +17,48 @@ func encodeThread(t messaging.Thread) response.Thread {
 	rt.Href = threadsURI + "/" + strconv.FormatInt(t.ThreadID, 10)
 
 	for _, i := range t.Participants {
-		l := response.Link{
-			Href: userURI + "/" + strconv.FormatInt(i, 10),
-		}
-		rt.Participants = append(rt.Participants, l)
+		rt.Participants = append(rt.Participants, encodeUserLink(i))
+	}
+	for _, r := range t.ReadMarkers {
+		rt.ReadBy = append(rt.ReadBy, encodeReadMarker(t.ThreadID, r))
 	}
 	return rt
 }
 
+func encodeReadMarker(tid int64, r messaging.ReadMarker) response.ReadMarker {
+	return response.ReadMarker{
+		User: encodeUserLink(r.UID),
+		Message: response.Link{
+			Href: threadsURI + "/" + strconv.FormatInt(tid, 10) + "/" + "messages" + "/" +
+				strconv.FormatInt(r.MessageID, 10),
+		},
+	}
+}
+
+func encodeTyping(e messaging.Typing) response.Typing {
+	return response.Typing{
+		Thread: response.Link{
+			Href: threadsURI + "/" + strconv.FormatInt(e.Thread.ThreadID, 10),
+		},
+		User:    encodeUserLink(e.UID),
+		Expires: e.Expires,
+	}
+}
+
+func encodeReceipts(rs []messaging.Receipt) []response.Receipt {
+	var rr []response.Receipt
+	for _, r := range rs {
+		rr = append(rr, response.Receipt{User: encodeUserLink(r.UID), Status: r.Status})
+	}
+	return rr
+}
+
+func encodeUserLink(uid int64) response.Link {
+	return response.Link{
+		Href: userURI + "/" + strconv.FormatInt(uid, 10),
+	}
+}
+
 func decodeThread(rt response.Thread, new bool) (messaging.Thread, error) {
 	var t messaging.Thread
 
@@ -44,6 +78,7 @@ func decodeThread(rt response.Thread, new bool) (messaging.Thread, error) {
 	return t, nil
 }
 
+//encodeMessage expects m as a user sees it, see messaging.Message.VisibleTo
 func encodeMessage(m messaging.Message) response.Message {
 	var rm response.Message
 
@@ -52,13 +87,81 @@ func encodeMessage(m messaging.Message) response.Message {
 	rm.From.Href = userURI + "/" + strconv.FormatInt(m.From, 10)
 	rm.Content = m.Content
 	rm.Time = m.Time
+	rm.Edited = m.Edited
+	rm.Deleted = m.Deleted != "" || len(m.HiddenFor) != 0
+
+	//Reactions are grouped by emoji, in the order each was first used
+	idx := map[string]int{}
+	for _, r := range m.Reactions {
+		i, ok := idx[r.Emoji]
+		if !ok {
+			i = len(rm.Reactions)
+			idx[r.Emoji] = i
+			rm.Reactions = append(rm.Reactions, response.Reaction{Emoji: r.Emoji})
+		}
+		rm.Reactions[i].Count++
+		rm.Reactions[i].Users = append(rm.Reactions[i].Users, encodeUserLink(r.UID))
+	}
+
+	if m.Root != 0 {
+		rm.Root = &response.Link{
+			Href: rm.ParentThread.Href + "/" + "messages" + "/" + strconv.FormatInt(m.Root, 10),
+		}
+	}
+	if m.ReplyCount != 0 {
+		rm.Replies = &response.Replies{Count: m.ReplyCount, Last: m.LastReply}
+		rm.Replies.Href = rm.Href + "/" + "replies"
+	}
+
+	if m.ReplyTo != 0 {
+		rm.ReplyTo = &response.Quote{}
+		rm.ReplyTo.Href = rm.ParentThread.Href + "/" + "messages" + "/" + strconv.FormatInt(m.ReplyTo, 10)
+		//Left with just the link if the message replied to is gone
+		if q := m.Quoted; q != nil {
+			quote := encodeQuote(*q)
+			rm.ReplyTo = &quote
+		}
+	}
 
 	return rm
 }
 
-func decodeMessage(rm response.Message, new bool) (messaging.Message, error) {
+//encodeQuote expects m as a user sees it, like encodeMessage
+func encodeQuote(m messaging.Message) response.Quote {
+	from := encodeUserLink(m.From)
+	q := response.Quote{
+		From:    &from,
+		Excerpt: excerpt(m.Content),
+		Time:    m.Time,
+		Deleted: m.Deleted != "" || len(m.HiddenFor) != 0,
+	}
+	q.Href = threadsURI + "/" + strconv.FormatInt(m.ParentThread, 10) + "/" + "messages" + "/" +
+		strconv.FormatInt(m.MessageID, 10)
+	return q
+}
+
+//maxExcerpt is the number of characters of a message quoted in a reply
+const maxExcerpt = 100
+
+//excerpt shortens s to maxExcerpt characters, on a word boundary if there is
+//one close enough
+func excerpt(s string) string {
+	r := []rune(s)
+	if len(r) <= maxExcerpt {
+		return s
+	}
+	cut := string(r[:maxExcerpt])
+	if i := strings.LastIndexAny(cut, " \t\n"); i > len(cut)*3/4 {
+		cut = strings.TrimRight(cut[:i], " \t\n")
+	}
+	return cut + "…"
+}
+
+//decodeMessage decodes rm, tid is the thread of a new message from the path
+func decodeMessage(rm response.Message, tid int64, new bool) (messaging.Message, error) {
 	var m messaging.Message
 	var err error
+	m.ParentThread = tid
 
 	if !new {
 		if m.ParentThread, err = getIDFromLink(rm.ParentThread.Href); err != nil {
@@ -81,6 +184,14 @@ func decodeMessage(rm response.Message, new bool) (messaging.Message, error) {
 	}
 	m.Time = rm.Time
 
+	if rm.ReplyTo != nil {
+		rtid, rmid, err := getMessageIDsFromLink(rm.ReplyTo.Href)
+		if err != nil || rtid != m.ParentThread {
+			return m, errors.New("Invalid replyTo, must be a message of the same thread")
+		}
+		m.ReplyTo = rmid
+	}
+
 	return m, nil
 }
 
@@ -88,10 +199,26 @@ func encodeUser(u user.User) response.User {
 	var ru response.User
 	ru.Href = userURI + "/" + strconv.FormatInt(u.UID, 10)
 	ru.Name = u.Name
-	ru.Secret = u.SecretKey
 	return ru
 }
 
+//encodeOwnUser encodes the user for itself, with its presence and settings
+func encodeOwnUser(u user.User) response.User {
+	ru := encodeUser(u)
+	rp := encodePresence(user.GetPresence(u))
+	ru.Presence = &rp
+	ru.PresencePrivacy = u.Privacy()
+	return ru
+}
+
+func encodePresence(pr user.Presence) response.Presence {
+	return response.Presence{
+		User:     encodeUserLink(pr.UID),
+		Status:   pr.Status,
+		LastSeen: pr.LastSeen,
+	}
+}
+
 func decodeUser(ru response.User, new bool) (user.User, error) {
 	var u user.User
 	var err error
@@ -103,15 +230,26 @@ func decodeUser(ru response.User, new bool) (user.User, error) {
 	return u, nil
 }
 
-func encodeAllThreads(k []int64) response.AllThreads {
+func encodeCredential(cr user.Credential) response.Credential {
+	var rc response.Credential
+	rc.Href = userURI + "/" + strconv.FormatInt(cr.UID, 10) + "/credentials/" +
+		strconv.FormatInt(cr.CredentialID, 10)
+	rc.Name = cr.Name
+	rc.Kind = cr.Kind
+	rc.Created = cr.Created
+	rc.Expires = cr.Expires
+	return rc
+}
+
+func encodeAllThreads(con messaging.AllThreads) response.AllThreads {
 	var rt response.AllThreads
 
-	for _, i := range k {
-		t := response.Link{
-			Href: threadsURI + "/" + strconv.FormatInt(i, 10),
-		}
+	for _, i := range con.Threads {
+		t := response.ThreadSummary{Unread: con.UnreadIn(i)}
+		t.Href = threadsURI + "/" + strconv.FormatInt(i, 10)
 		rt.Threads = append(rt.Threads, t)
 	}
+	rt.Unread = con.TotalUnread()
 	return rt
 }
 
@@ -124,6 +262,24 @@ func getIDFromLink(link string) (int64, error) {
 	return i, nil
 }
 
+//getMessageIDsFromLink parses the thread and message id of a link to a message,
+//".../threads/{threadID}/messages/{messageID}"
+func getMessageIDsFromLink(link string) (int64, int64, error) {
+	s := strings.Split(link, "/")
+	if len(s) < 4 || s[len(s)-4] != "threads" || s[len(s)-2] != "messages" {
+		return 0, 0, errors.New("Not a link to a message")
+	}
+	tid, err := strconv.ParseInt(s[len(s)-3], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("Could not parse id")
+	}
+	mid, err := strconv.ParseInt(s[len(s)-1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("Could not parse id")
+	}
+	return tid, mid, nil
+}
+
 func removeDuplicates(elements []int64) []int64 {
 	// Use map to record duplicates as we find them.
 	encountered := map[int64]bool{}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+func TestInboxCursor(t *testing.T) {
+	u, o := newTestUser(t), newTestUser(t)
+	var tids []int64
+	for i := 0; i < 3; i++ {
+		tids = append(tids, newTestThread(t, u, o))
+	}
+	//The first thread gets the latest activity, which is kept to the second
+	time.Sleep(1100 * time.Millisecond)
+	postMessage(t, o, tids[0], "latest", time.Now().UTC().Format(time.RFC3339))
+
+	var first response.Inbox
+	decode(t, mustDo(t, http.StatusOK, u, "GET", inboxURI+"?limit=2", nil), &first)
+	if len(first.Threads) != 2 || first.Next == "" {
+		t.Fatalf("Got first page %+v", first)
+	}
+	if first.Threads[0].Href != threadPath(tids[0]) {
+		t.Errorf("Got %s first, want the thread with the latest message", first.Threads[0].Href)
+	}
+	if first.Unread != 1 || first.Threads[0].Unread != 1 {
+		t.Errorf("Got %d unread, %d in the thread, want 1", first.Unread, first.Threads[0].Unread)
+	}
+
+	var second response.Inbox
+	decode(t, mustDo(t, http.StatusOK, u, "GET", inboxURI+"?limit=2&cursor="+first.Next, nil), &second)
+	if len(second.Threads) != 1 || second.Next != "" {
+		t.Fatalf("Got second page %+v", second)
+	}
+	seen := map[string]bool{}
+	for _, rt := range append(first.Threads, second.Threads...) {
+		if seen[rt.Href] {
+			t.Errorf("%s listed twice", rt.Href)
+		}
+		seen[rt.Href] = true
+	}
+
+	mustDo(t, http.StatusBadRequest, u, "GET", inboxURI+"?cursor=garbage", nil)
+}
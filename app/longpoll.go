@@ -0,0 +1,70 @@
+package app
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/messaging"
+)
+
+//maxWait is the longest a request may wait for new messages, in seconds
+const maxWait = 60
+
+//waiters are the channels of the requests waiting for a message in a thread
+var waiters = struct {
+	sync.Mutex
+	threads map[int64]map[chan struct{}]bool
+}{threads: make(map[int64]map[chan struct{}]bool)}
+
+//shutdown is closed by stopWaiting, waiting requests then return right away
+var shutdown = make(chan struct{})
+
+var stopOnce sync.Once
+
+func stopWaiting() {
+	stopOnce.Do(func() { close(shutdown) })
+}
+
+func init() {
+	messaging.Subscribe(func(c context.Context, e messaging.Event) {
+		//Replies are not in the messages of the thread
+		if m, ok := e.(messaging.MessageInserted); ok && m.Message.Root == 0 {
+			wake(m.Thread.ThreadID)
+		}
+	})
+}
+
+//waitForMessage returns a channel closed on the next message inserted in the
+//thread, and the func to stop waiting. It only sees the messages inserted by
+//this instance
+func waitForMessage(tid int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	waiters.Lock()
+	if waiters.threads[tid] == nil {
+		waiters.threads[tid] = make(map[chan struct{}]bool)
+	}
+	waiters.threads[tid][ch] = true
+	waiters.Unlock()
+
+	return ch, func() {
+		waiters.Lock()
+		defer waiters.Unlock()
+		if _, ok := waiters.threads[tid][ch]; ok {
+			delete(waiters.threads[tid], ch)
+			if len(waiters.threads[tid]) == 0 {
+				delete(waiters.threads, tid)
+			}
+		}
+	}
+}
+
+func wake(tid int64) {
+	waiters.Lock()
+	defer waiters.Unlock()
+	for ch := range waiters.threads[tid] {
+		close(ch)
+	}
+	delete(waiters.threads, tid)
+}
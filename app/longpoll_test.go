@@ -0,0 +1,57 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+func TestLongPoll(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	postMessage(t, a, tid, "before", testTime(1))
+
+	//Nothing comes, so the wait runs out with no messages
+	var rm []response.Message
+	decode(t, mustDo(t, http.StatusOK, b, "GET",
+		threadPath(tid)+"/messages?wait=1&time="+testTime(1), nil), &rm)
+	if len(rm) != 0 {
+		t.Fatalf("Got %+v, want no messages", rm)
+	}
+
+	done := make(chan []response.Message)
+	go func() {
+		var rm []response.Message
+		defer func() { done <- rm }()
+
+		req, _ := http.NewRequest("GET", srv.URL+threadPath(tid)+"/messages?wait=10&time="+testTime(1), nil)
+		req.SetBasicAuth(strconv.FormatInt(b.UID, 10), b.Secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return
+		}
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(&rm)
+	}()
+
+	//Let the request start waiting, a message sent before is found anyway
+	time.Sleep(100 * time.Millisecond)
+	postMessage(t, a, tid, "after", testTime(2))
+
+	select {
+	case rm := <-done:
+		if len(rm) != 1 || rm[0].Content != "after" {
+			t.Errorf("Got %+v, want the new message", rm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The waiting request was not woken by the new message")
+	}
+
+	mustDo(t, http.StatusBadRequest, b, "GET", threadPath(tid)+"/messages?wait=1", nil)
+	mustDo(t, http.StatusBadRequest, b, "GET",
+		threadPath(tid)+"/messages?wait=61&time="+testTime(1), nil)
+}
@@ -0,0 +1,329 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+//postReply adds a reply to the message as u and returns its id
+func postReply(t *testing.T, u testUser, tid int64, root int64, content string, at string) int64 {
+	t.Helper()
+
+	mustDo(t, http.StatusCreated, u, "POST", messagePath(tid, root)+"/replies",
+		response.Message{Content: content, Time: at})
+
+	var rm []response.Message
+	decode(t, mustDo(t, http.StatusOK, u, "GET", messagePath(tid, root)+"/replies", nil), &rm)
+	for _, m := range rm {
+		if m.Content == content {
+			_, mid, err := getMessageIDsFromLink(m.Href)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return mid
+		}
+	}
+	t.Fatalf("Reply %q not found after sending it", content)
+	return 0
+}
+
+func TestChangeReply(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	root := postMessage(t, a, tid, "root", testTime(1))
+	reply := postReply(t, b, tid, root, "reply", testTime(2))
+
+	var rm response.Message
+	decode(t, mustDo(t, http.StatusOK, a, "GET", messagePath(tid, reply), nil), &rm)
+	if rm.Content != "reply" || rm.Root == nil || rm.Root.Href != messagePath(tid, root) {
+		t.Fatalf("Got reply %+v", rm)
+	}
+
+	decode(t, mustDo(t, http.StatusOK, b, "PATCH", messagePath(tid, reply),
+		response.Message{Content: "edited"}), &rm)
+	if rm.Content != "edited" || rm.Edited == "" {
+		t.Errorf("Got %+v after editing", rm)
+	}
+
+	decode(t, mustDo(t, http.StatusOK, a, "POST", messagePath(tid, reply)+"/reactions",
+		response.Reaction{Emoji: "👍"}), &rm)
+	if len(rm.Reactions) != 1 {
+		t.Errorf("Got reactions %+v", rm.Reactions)
+	}
+
+	//Reading the reply marks its root read
+	var marker response.ReadMarker
+	decode(t, mustDo(t, http.StatusOK, a, "POST", messagePath(tid, reply)+"/read", nil), &marker)
+	if marker.Message.Href != messagePath(tid, root) {
+		t.Errorf("Read marker at %s, want the root", marker.Message.Href)
+	}
+
+	mustDo(t, http.StatusNoContent, b, "DELETE", messagePath(tid, reply)+"?for=everyone", nil)
+	decode(t, mustDo(t, http.StatusOK, a, "GET", messagePath(tid, reply), nil), &rm)
+	if !rm.Deleted || rm.Content != "" {
+		t.Errorf("Got %+v after deleting for everyone", rm)
+	}
+
+	//Sub-threads are not nested
+	mustDo(t, http.StatusNotFound, a, "POST", messagePath(tid, reply)+"/replies",
+		response.Message{Content: "nested", Time: testTime(3)})
+}
+
+func TestGetReplies(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	root := postMessage(t, a, tid, "root", testTime(1))
+	plain := postMessage(t, a, tid, "plain", testTime(2))
+	reply := postReply(t, b, tid, root, "first", testTime(3))
+	postReply(t, a, tid, root, "second", testTime(4))
+
+	var rm []response.Message
+	decode(t, mustDo(t, http.StatusOK, a, "GET", messagePath(tid, root)+"/replies", nil), &rm)
+	if len(rm) != 2 {
+		t.Errorf("Got replies %+v, want 2", rm)
+	}
+	decode(t, mustDo(t, http.StatusOK, a, "GET", messagePath(tid, plain)+"/replies", nil), &rm)
+	if len(rm) != 0 {
+		t.Errorf("Got replies %+v of a message without any", rm)
+	}
+
+	mustDo(t, http.StatusNotFound, a, "GET", messagePath(tid, root+1000)+"/replies", nil)
+	mustDo(t, http.StatusNotFound, a, "GET", messagePath(tid, reply)+"/replies", nil)
+}
+
+func TestMarkRead(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	first := postMessage(t, a, tid, "first", testTime(1))
+	second := postMessage(t, a, tid, "second", testTime(2))
+
+	var marker response.ReadMarker
+	decode(t, mustDo(t, http.StatusOK, b, "POST", messagePath(tid, first)+"/read", nil), &marker)
+	if marker.Message.Href != messagePath(tid, first) {
+		t.Fatalf("Read marker at %s, want the first message", marker.Message.Href)
+	}
+	decode(t, mustDo(t, http.StatusOK, b, "POST", messagePath(tid, second)+"/read", nil), &marker)
+	if marker.Message.Href != messagePath(tid, second) {
+		t.Fatalf("Read marker at %s, want the second message", marker.Message.Href)
+	}
+
+	//It never moves back
+	decode(t, mustDo(t, http.StatusOK, b, "POST", messagePath(tid, first)+"/read", nil), &marker)
+	if marker.Message.Href != messagePath(tid, second) {
+		t.Errorf("Read marker moved back to %s", marker.Message.Href)
+	}
+}
+
+func TestUnreadAfterMarker(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	//Sent within the same second, they are ordered by id
+	first := postMessage(t, a, tid, "first", testTime(1))
+	postMessage(t, a, tid, "second", testTime(1))
+	postMessage(t, a, tid, "third", testTime(1))
+
+	mustDo(t, http.StatusOK, b, "POST", messagePath(tid, first)+"/read", nil)
+
+	var inbox response.Inbox
+	decode(t, mustDo(t, http.StatusOK, b, "GET", inboxURI, nil), &inbox)
+	for _, rt := range inbox.Threads {
+		if rt.Href == threadPath(tid) {
+			if rt.Unread != 2 {
+				t.Errorf("Got %d unread, want the 2 messages after the marker", rt.Unread)
+			}
+			return
+		}
+	}
+	t.Fatalf("Thread not in the inbox %+v", inbox)
+}
+
+func TestDeliveredNotFound(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	mid := postMessage(t, a, tid, "hello", testTime(1))
+
+	mustDo(t, http.StatusNoContent, b, "POST", messagePath(tid, mid)+"/delivered", nil)
+	mustDo(t, http.StatusNotFound, b, "POST", messagePath(tid, mid+1000)+"/delivered", nil)
+	mustDo(t, http.StatusNotFound, b, "GET", messagePath(tid, mid+1000), nil)
+}
+
+func TestMessagesOnlyForParticipants(t *testing.T) {
+	a, b, outsider := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	postMessage(t, a, tid, "hello", testTime(1))
+
+	mustDo(t, http.StatusUnauthorized, outsider, "GET", threadPath(tid)+"/messages", nil)
+	//Turned away before waiting, not after the wait runs out
+	start := time.Now()
+	mustDo(t, http.StatusUnauthorized, outsider, "GET",
+		threadPath(tid)+"/messages?wait=5&time="+testTime(1), nil)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Outsider waited %v", d)
+	}
+}
+
+func TestOnlyParticipantsPost(t *testing.T) {
+	a, b, outsider := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	postMessage(t, a, tid, "hello", testTime(1))
+
+	mustDo(t, http.StatusUnauthorized, outsider, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: "intruding", Time: testTime(2)})
+	if ms := getMessages(t, b, tid); len(ms) != 1 {
+		t.Errorf("Got %+v, want only the message of a participant", ms)
+	}
+	mustDo(t, http.StatusNotFound, a, "POST", threadPath(tid+1000)+"/messages",
+		response.Message{Content: "nowhere", Time: testTime(2)})
+}
+
+func TestEditMessage(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	mid := postMessage(t, a, tid, "typo", testTime(1))
+
+	var rm response.Message
+	decode(t, mustDo(t, http.StatusOK, a, "PATCH", messagePath(tid, mid),
+		response.Message{Content: "fixed"}), &rm)
+	if rm.Content != "fixed" || rm.Edited == "" {
+		t.Errorf("Got %+v after editing", rm)
+	}
+	mustDo(t, http.StatusOK, a, "PATCH", messagePath(tid, mid), response.Message{Content: "fixed again"})
+
+	var rr []response.Revision
+	decode(t, mustDo(t, http.StatusOK, b, "GET", messagePath(tid, mid)+"/revisions", nil), &rr)
+	if len(rr) != 2 || rr[0].Content != "typo" || rr[0].Time != testTime(1) || rr[1].Content != "fixed" {
+		t.Errorf("Got revisions %+v, want typo then fixed", rr)
+	}
+	if ms := getMessages(t, b, tid); len(ms) != 1 || ms[0].Content != "fixed again" {
+		t.Errorf("Got %+v, want the edited content", ms)
+	}
+
+	mustDo(t, http.StatusForbidden, b, "PATCH", messagePath(tid, mid), response.Message{Content: "mine"})
+	mustDo(t, http.StatusNotFound, a, "PATCH", messagePath(tid, mid+1000), response.Message{Content: "gone"})
+	mustDo(t, http.StatusNotFound, a, "GET", messagePath(tid, mid+1000)+"/revisions", nil)
+
+	//Deleting for everyone takes the revisions with it
+	mustDo(t, http.StatusNoContent, a, "DELETE", messagePath(tid, mid)+"?for=everyone", nil)
+	mustDo(t, http.StatusConflict, a, "PATCH", messagePath(tid, mid), response.Message{Content: "back"})
+	decode(t, mustDo(t, http.StatusOK, b, "GET", messagePath(tid, mid)+"/revisions", nil), &rr)
+	if len(rr) != 0 {
+		t.Errorf("Got revisions %+v of a deleted message", rr)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	mid := postMessage(t, a, tid, "react to me", testTime(1))
+	path := messagePath(tid, mid) + "/reactions"
+
+	mustDo(t, http.StatusOK, a, "POST", path, response.Reaction{Emoji: "👍"})
+	//Reacting twice with the same emoji counts once
+	mustDo(t, http.StatusOK, a, "POST", path, response.Reaction{Emoji: "👍"})
+	var rm response.Message
+	decode(t, mustDo(t, http.StatusOK, b, "POST", path, response.Reaction{Emoji: "👍"}), &rm)
+	if len(rm.Reactions) != 1 || rm.Reactions[0].Count != 2 || len(rm.Reactions[0].Users) != 2 {
+		t.Fatalf("Got reactions %+v, want 👍 by both", rm.Reactions)
+	}
+
+	decode(t, mustDo(t, http.StatusOK, a, "DELETE", path+"?emoji="+url.QueryEscape("👍"), nil), &rm)
+	if len(rm.Reactions) != 1 || rm.Reactions[0].Count != 1 || rm.Reactions[0].Users[0].Href != b.href() {
+		t.Errorf("Got reactions %+v, want 👍 by %s", rm.Reactions, b.href())
+	}
+
+	for _, e := range []string{"", "a b", "x\n", strings.Repeat("👍", 9)} {
+		mustDo(t, http.StatusBadRequest, a, "POST", path, response.Reaction{Emoji: e})
+	}
+	mustDo(t, http.StatusBadRequest, a, "DELETE", path, nil)
+	mustDo(t, http.StatusNotFound, a, "POST", messagePath(tid, mid+1000)+"/reactions",
+		response.Reaction{Emoji: "👍"})
+
+	outsider := newTestUser(t)
+	mustDo(t, http.StatusUnauthorized, outsider, "POST", path, response.Reaction{Emoji: "👍"})
+}
+
+func TestQuoting(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+	long := strings.Repeat("word ", 40)
+	mid := postMessage(t, a, tid, long, testTime(1))
+
+	quote := func(mid int64) *response.Quote {
+		return &response.Quote{Link: response.Link{Href: messagePath(tid, mid)}}
+	}
+	mustDo(t, http.StatusCreated, b, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: "quoting", Time: testTime(2), ReplyTo: quote(mid)})
+
+	var q *response.Quote
+	for _, m := range getMessages(t, a, tid) {
+		if m.Content == "quoting" {
+			q = m.ReplyTo
+		}
+	}
+	if q == nil || q.Href != messagePath(tid, mid) || q.From == nil || q.From.Href != a.href() ||
+		q.Time != testTime(1) || q.Deleted {
+		t.Fatalf("Got quote %+v, want the message of %s", q, a.href())
+	}
+	if !strings.HasSuffix(q.Excerpt, "…") || len([]rune(q.Excerpt)) > maxExcerpt+1 ||
+		!strings.HasPrefix(long, strings.TrimSuffix(q.Excerpt, "…")) {
+		t.Errorf("Got excerpt %q, want the start of the message", q.Excerpt)
+	}
+
+	//Only messages of the same thread can be quoted
+	other := newTestThread(t, a, b)
+	omid := postMessage(t, a, other, "elsewhere", testTime(3))
+	mustDo(t, http.StatusBadRequest, b, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: "bad", Time: testTime(4), ReplyTo: quote(omid)})
+	mustDo(t, http.StatusBadRequest, b, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: "bad", Time: testTime(4), ReplyTo: quote(mid + 1000)})
+	mustDo(t, http.StatusBadRequest, b, "POST", threadPath(tid)+"/messages",
+		response.Message{Content: "bad", Time: testTime(4),
+			ReplyTo: &response.Quote{Link: response.Link{Href: "/nowhere"}}})
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	a, b, c := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b, c)
+	mid := postMessage(t, a, tid, "status", testTime(1))
+
+	receipts := func() map[string]string {
+		var rm response.Message
+		decode(t, mustDo(t, http.StatusOK, a, "GET", messagePath(tid, mid), nil), &rm)
+		got := map[string]string{}
+		for _, r := range rm.Receipts {
+			got[r.User.Href] = r.Status
+		}
+		return got
+	}
+	check := func(bs, cs string) {
+		t.Helper()
+		if got := receipts(); len(got) != 2 || got[b.href()] != bs || got[c.href()] != cs {
+			t.Errorf("Got receipts %v, want %s for b and %s for c", got, bs, cs)
+		}
+	}
+
+	check("sent", "sent")
+	//Fetching the messages delivers them
+	getMessages(t, b, tid)
+	check("delivered", "sent")
+	mustDo(t, http.StatusNoContent, c, "POST", messagePath(tid, mid)+"/delivered", nil)
+	check("delivered", "delivered")
+	mustDo(t, http.StatusOK, b, "POST", messagePath(tid, mid)+"/read", nil)
+	check("read", "delivered")
+
+	//Only the sender gets the receipts
+	var rm response.Message
+	decode(t, mustDo(t, http.StatusOK, b, "GET", messagePath(tid, mid), nil), &rm)
+	if len(rm.Receipts) != 0 {
+		t.Errorf("Got receipts %+v as a recipient", rm.Receipts)
+	}
+
+	outsider := newTestUser(t)
+	mustDo(t, http.StatusUnauthorized, outsider, "GET", messagePath(tid, mid), nil)
+	mustDo(t, http.StatusNotFound, a, "GET", messagePath(tid, mid+1000), nil)
+}
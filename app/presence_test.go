@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+//presenceOf returns the presence of u as seen by viewer, nil if hidden
+func presenceOf(t *testing.T, viewer testUser, u testUser) *response.Presence {
+	t.Helper()
+	var ru response.User
+	decode(t, mustDo(t, http.StatusOK, viewer, "GET", u.href(), nil), &ru)
+	return ru.Presence
+}
+
+func TestPresencePrivacy(t *testing.T) {
+	u, contact, stranger := newTestUser(t), newTestUser(t), newTestUser(t)
+
+	//Seen by its own requests
+	mustDo(t, http.StatusOK, u, "GET", u.href(), nil)
+	if rp := presenceOf(t, stranger, u); rp == nil || rp.Status != "online" {
+		t.Fatalf("Got presence %+v, want online to everyone", rp)
+	}
+
+	mustDo(t, http.StatusOK, u, "PATCH", u.href(), response.User{PresencePrivacy: "contacts"})
+	newTestThread(t, u, contact)
+	if rp := presenceOf(t, contact, u); rp == nil {
+		t.Error("Presence hidden from a contact")
+	}
+	if rp := presenceOf(t, stranger, u); rp != nil {
+		t.Errorf("Presence %+v shown to a user sharing no thread", rp)
+	}
+
+	mustDo(t, http.StatusOK, u, "PATCH", u.href(), response.User{PresencePrivacy: "nobody"})
+	if rp := presenceOf(t, contact, u); rp != nil {
+		t.Errorf("Presence %+v shown with the privacy set to nobody", rp)
+	}
+
+	mustDo(t, http.StatusBadRequest, u, "PATCH", u.href(), response.User{PresencePrivacy: "friends"})
+}
+
+func TestNoThreadsNoContacts(t *testing.T) {
+	c := context.Background()
+	u, o := newTestUser(t), newTestUser(t)
+
+	uids, err := contacts(c, u.UID)
+	if err != nil || len(uids) != 0 {
+		t.Errorf("Got contacts %v, %v for a user in no thread", uids, err)
+	}
+	if shares, err := sharesThread(c, u.UID, o.UID); err != nil || shares {
+		t.Errorf("Got %v, %v for users in no thread", shares, err)
+	}
+}
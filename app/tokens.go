@@ -0,0 +1,110 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+	"github.com/abhicnv007/messenger-server/token"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//keyring signs and verifies access tokens, Bearer auth is off while it is nil
+var keyring *token.Keyring
+
+//accessTokenTTL is how long an access token lasts
+var accessTokenTTL = 15 * time.Minute
+
+//SetTokenKeyring turns Bearer auth on, signing access tokens with the keys
+func SetTokenKeyring(k *token.Keyring) {
+	keyring = k
+}
+
+//SetAccessTokenTTL sets how long an access token lasts
+func SetAccessTokenTTL(ttl time.Duration) {
+	accessTokenTTL = ttl
+}
+
+//issueTokens returns an access token for the refresh credential cr, along with
+//the refresh token
+func issueTokens(cr user.Credential, refresh string) (response.Tokens, error) {
+	now := time.Now()
+	access, err := keyring.Sign(token.Claims{
+		UID:          cr.UID,
+		CredentialID: cr.CredentialID,
+		IssuedAt:     now.Unix(),
+		Expires:      now.Add(accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return response.Tokens{}, err
+	}
+
+	return response.Tokens{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+		RefreshToken: refresh,
+	}, nil
+}
+
+/*
+refreshTokens exchanges a refresh token for a new access token, the refresh
+token can only be used once and a new one is sent back with the access token.
+Using it again revokes the session, as the token must have been stolen
+
+Request: POST request to "/token" with JSON body containing the refresh token
+
+Response: if successful, (status 200/ StatusOK), is a JSON object with the
+access token to send as "Authorization: Bearer {token}" and the new refresh
+token
+	If unsuccessful, StatusUnauthorized/401
+
+Testing-->
+
+curl -i --request POST \
+--header 'content-type: application/json' \
+--url "localhost:8080/token" \
+--data '{"refresh_token" : "1006.wSfq1IERMjoC8oK4VOj3SfCdmy08CUWE5zTzrDeckavTzmvHynr1Ce7lCqZHFlYG"}'
+*/
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+
+	if keyring == nil {
+		response.New(w).WithCode(http.StatusNotFound).
+			Error("Access tokens are not enabled")
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response.New(w).WithCode(http.StatusBadRequest).
+			Error("Could not read the body")
+		return
+	}
+
+	var rt response.Tokens
+	if err = json.Unmarshal(b, &rt); err != nil || rt.RefreshToken == "" {
+		response.New(w).WithCode(http.StatusBadRequest).
+			Error("No refresh token given")
+		return
+	}
+
+	cr, refresh, err := user.ExchangeRefreshToken(c, rt.RefreshToken)
+	if err != nil {
+		response.New(w).WithCode(http.StatusUnauthorized).Error(err.Error())
+		return
+	}
+
+	rt, err = issueTokens(cr, refresh)
+	if err != nil {
+		log.Println("Could not sign an access token", err)
+		response.New(w).WithCode(http.StatusInternalServerError).
+			Error("Could not create an access token")
+		return
+	}
+
+	response.New(w).WithCode(http.StatusOK).WithData(rt)
+}
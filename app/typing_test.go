@@ -0,0 +1,44 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+func TestStartTyping(t *testing.T) {
+	a, b, outsider := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	sa, sb := openEvents(t, a, ""), openEvents(t, b, "")
+	defer sa.close()
+	defer sb.close()
+	conn := openLive(t, b)
+	defer conn.Close()
+
+	var rt response.Typing
+	decode(t, mustDo(t, http.StatusOK, a, "POST", threadPath(tid)+"/typing", nil), &rt)
+	if rt.Thread.Href != threadPath(tid) || rt.User.Href != a.href() {
+		t.Errorf("Got %+v, want %s typing in the thread", rt, a.href())
+	}
+	if e, err := time.Parse(time.RFC3339, rt.Expires); err != nil || !e.After(time.Now()) {
+		t.Errorf("Got expiry %q, want one in the future", rt.Expires)
+	}
+
+	//Passed on to the others, who get it without an id as it is not kept
+	var got response.Typing
+	e := sb.next(t, eventTyping)
+	decode(t, e.Data, &got)
+	if e.ID != "" || got != rt {
+		t.Errorf("Got %+v with id %q, want %+v", got, e.ID, rt)
+	}
+	if f := nextFrame(t, conn, frameTyping); *f.Typing != rt {
+		t.Errorf("Got frame %+v, want %+v", f.Typing, rt)
+	}
+	sa.none(t, eventTyping, 200*time.Millisecond)
+
+	mustDo(t, http.StatusUnauthorized, outsider, "POST", threadPath(tid)+"/typing", nil)
+	mustDo(t, http.StatusNotFound, a, "POST", threadPath(tid+1000)+"/typing", nil)
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+//openLive connects to /live as the user and waits until it gets updates
+func openLive(t *testing.T, u testUser) *websocket.Conn {
+	t.Helper()
+
+	h := http.Header{}
+	h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(u.UID, 10)+":"+u.Secret)))
+
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+liveURI, h)
+	if err != nil {
+		t.Fatal("Opening the live updates:", err, res)
+	}
+	//The client is registered once frames are answered
+	conn.WriteJSON(response.Frame{Type: framePing})
+	nextFrame(t, conn, framePong)
+	return conn
+}
+
+//nextFrame returns the next frame of the given type, skipping the others
+func nextFrame(t *testing.T, conn *websocket.Conn, typ string) response.Frame {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f response.Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("Waiting for a %s frame: %v", typ, err)
+		}
+		if f.Type == typ {
+			return f
+		}
+	}
+}
+
+func TestLivePushesMessages(t *testing.T) {
+	a, b := newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	conn := openLive(t, a)
+	defer conn.Close()
+
+	mid := postMessage(t, b, tid, "pushed", testTime(1))
+	f := nextFrame(t, conn, frameMessage)
+	if f.Message.Content != "pushed" || f.Message.Href != messagePath(tid, mid) {
+		t.Fatalf("Got %+v, want the message sent", f.Message)
+	}
+
+	//Written frames count as delivered, right after being written
+	var status string
+	for i := 0; i < 50 && status != "delivered"; i++ {
+		var rm response.Message
+		decode(t, mustDo(t, http.StatusOK, b, "GET", messagePath(tid, mid), nil), &rm)
+		if len(rm.Receipts) != 1 {
+			t.Fatalf("Got receipts %+v, want one for %s", rm.Receipts, a.href())
+		}
+		status = rm.Receipts[0].Status
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != "delivered" {
+		t.Errorf("Got %q for the pushed message, want delivered", status)
+	}
+
+	//Unsubscribed threads are not pushed any more
+	thread := &response.Link{Href: threadPath(tid)}
+	conn.WriteJSON(response.Frame{Type: frameUnsubscribe, Thread: thread})
+	nextFrame(t, conn, frameUnsubscribed)
+	postMessage(t, b, tid, "muted", testTime(2))
+	conn.WriteJSON(response.Frame{Type: framePing})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f response.Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == frameMessage {
+			t.Fatalf("Got %+v from an unsubscribed thread", f.Message)
+		}
+		if f.Type == framePong {
+			break
+		}
+	}
+
+	conn.WriteJSON(response.Frame{Type: frameSubscribe, Thread: thread})
+	nextFrame(t, conn, frameSubscribed)
+	postMessage(t, b, tid, "again", testTime(3))
+	if f = nextFrame(t, conn, frameMessage); f.Message.Content != "again" {
+		t.Errorf("Got %+v after subscribing again", f.Message)
+	}
+}
+
+func TestLiveSubscribeOnlyParticipants(t *testing.T) {
+	a, b, outsider := newTestUser(t), newTestUser(t), newTestUser(t)
+	tid := newTestThread(t, a, b)
+
+	conn := openLive(t, outsider)
+	defer conn.Close()
+
+	conn.WriteJSON(response.Frame{Type: frameSubscribe, Thread: &response.Link{Href: threadPath(tid)}})
+	if f := nextFrame(t, conn, frameError); f.Thread == nil || f.Thread.Href != threadPath(tid) {
+		t.Errorf("Got %+v, want an error about the thread", f)
+	}
+}
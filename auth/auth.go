@@ -0,0 +1,54 @@
+//Package auth carries who a request is authenticated as through its context
+package auth
+
+import (
+	"golang.org/x/net/context"
+)
+
+//Methods a request can be authenticated with
+const (
+	MethodBasic  = "basic"
+	MethodBearer = "bearer"
+)
+
+//ScopeAll grants everything
+const ScopeAll = "*"
+
+//Principal is who a request is authenticated as
+type Principal struct {
+	//UID is the authenticated user
+	UID int64
+	//CredentialID is the credential the request was authenticated with, for
+	//an access token it is the refresh credential it was issued from
+	CredentialID int64
+	//Scopes are what the credential is allowed to do
+	Scopes []string
+	//Method is how the request was authenticated, one of the Method consts
+	Method string
+}
+
+//HasScope reports whether the principal is allowed s
+func (p Principal) HasScope(s string) bool {
+	for _, sc := range p.Scopes {
+		if sc == s || sc == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+//principalKey is unexported so no other package can set or read the value
+//except through NewContext and FromContext
+type principalKey struct{}
+
+//NewContext returns a copy of c carrying p
+func NewContext(c context.Context, p Principal) context.Context {
+	return context.WithValue(c, principalKey{}, p)
+}
+
+//FromContext returns the principal carried by c, ok is false if there is
+//none, as for requests to routes without authentication
+func FromContext(c context.Context) (p Principal, ok bool) {
+	p, ok = c.Value(principalKey{}).(Principal)
+	return p, ok
+}
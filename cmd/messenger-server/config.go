@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/abhicnv007/messenger-server/token"
+)
+
+//config of the server. Every field can be set, from lowest to highest
+//precedence, in the YAML file given with -config, from the environment or
+//with a flag
+type config struct {
+	//Addr is the address to listen on
+	Addr string `yaml:"addr"`
+
+	//Storage is the backend to use, "memory" or "sqlite"
+	Storage string `yaml:"storage"`
+	//SQLitePath is the database file used by the sqlite backend
+	SQLitePath string `yaml:"sqlite_path"`
+
+	//TLSCert and TLSKey are the paths of the certificate and key to serve
+	//HTTPS with, plain HTTP is served if they are not set
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	//LegacyLogin keeps serving the deprecated login with GET "/users"
+	LegacyLogin bool `yaml:"legacy_login"`
+	//SessionTTL is how long the credential issued on login lasts, like "720h"
+	SessionTTL string `yaml:"session_ttl"`
+
+	//TokenKeys turns on access tokens, as comma separated "{id}:{secret}"
+	//pairs where the secret is at least 32 bytes encoded in base64. The first
+	//key signs new tokens, the others only verify the ones signed before
+	//rotating keys
+	TokenKeys string `yaml:"token_keys"`
+	//AccessTokenTTL is how long an access token lasts, like "15m"
+	AccessTokenTTL string `yaml:"access_token_ttl"`
+
+	//TrustedProxies are the comma separated ips or CIDR ranges of the
+	//proxies in front of the server, whose X-Forwarded-For header is used
+	//to tell clients apart for rate limiting
+	TrustedProxies string `yaml:"trusted_proxies"`
+
+	//migratePasswords hashes all legacy plaintext passwords and exits
+	//instead of serving, it can only be set with a flag
+	migratePasswords bool
+}
+
+var defaultConfig = config{
+	Addr:           ":8080",
+	Storage:        "sqlite",
+	SQLitePath:     "messenger.db",
+	LegacyLogin:    true,
+	SessionTTL:     "720h",
+	AccessTokenTTL: "15m",
+}
+
+//sessionTTL returns SessionTTL parsed
+func (cfg config) sessionTTL() (time.Duration, error) {
+	return time.ParseDuration(cfg.SessionTTL)
+}
+
+//accessTokenTTL returns AccessTokenTTL parsed
+func (cfg config) accessTokenTTL() (time.Duration, error) {
+	return time.ParseDuration(cfg.AccessTokenTTL)
+}
+
+//keyring returns the keyring made of TokenKeys, or nil if there are none
+func (cfg config) keyring() (*token.Keyring, error) {
+	if cfg.TokenKeys == "" {
+		return nil, nil
+	}
+
+	var keys []token.Key
+	for _, pair := range strings.Split(cfg.TokenKeys, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Token keys have to be {id}:{secret}")
+		}
+		sec, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, errors.New("Secret of token key " + kv[0] + " is not base64")
+		}
+		keys = append(keys, token.Key{ID: kv[0], Secret: sec})
+	}
+	return token.NewKeyring(keys...)
+}
+
+//trustedProxies returns TrustedProxies parsed, a single ip being a range of
+//its own
+func (cfg config) trustedProxies() ([]*net.IPNet, error) {
+	if cfg.TrustedProxies == "" {
+		return nil, nil
+	}
+
+	var nets []*net.IPNet
+	for _, p := range strings.Split(cfg.TrustedProxies, ",") {
+		p = strings.TrimSpace(p)
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.New(p + " is neither an ip nor a CIDR range")
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//configVar ties a field of config to its flag and environment variable
+type configVar struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(cfg *config, v string) error
+}
+
+func setString(field func(cfg *config) *string) func(cfg *config, v string) error {
+	return func(cfg *config, v string) error {
+		*field(cfg) = v
+		return nil
+	}
+}
+
+func setBool(field func(cfg *config) *bool) func(cfg *config, v string) error {
+	return func(cfg *config, v string) error {
+		b, err := strconv.ParseBool(v)
+		*field(cfg) = b
+		return err
+	}
+}
+
+var configVars = []configVar{
+	{"addr", "MESSENGER_ADDR", "address to listen on", false,
+		setString(func(cfg *config) *string { return &cfg.Addr })},
+	{"storage", "MESSENGER_STORAGE", "storage backend, memory or sqlite", false,
+		setString(func(cfg *config) *string { return &cfg.Storage })},
+	{"sqlite-path", "MESSENGER_SQLITE_PATH", "database file of the sqlite storage backend", false,
+		setString(func(cfg *config) *string { return &cfg.SQLitePath })},
+	{"tls-cert", "MESSENGER_TLS_CERT", "TLS certificate file, serves plain HTTP if not set", false,
+		setString(func(cfg *config) *string { return &cfg.TLSCert })},
+	{"tls-key", "MESSENGER_TLS_KEY", "TLS key file", false,
+		setString(func(cfg *config) *string { return &cfg.TLSKey })},
+	{"legacy-login", "MESSENGER_LEGACY_LOGIN", "serve the deprecated login with GET /users", true,
+		setBool(func(cfg *config) *bool { return &cfg.LegacyLogin })},
+	{"session-ttl", "MESSENGER_SESSION_TTL", "how long the credential issued on login lasts", false,
+		setString(func(cfg *config) *string { return &cfg.SessionTTL })},
+	{"token-keys", "MESSENGER_TOKEN_KEYS", "access token keys as comma separated {id}:{base64 secret}, the first signs", false,
+		setString(func(cfg *config) *string { return &cfg.TokenKeys })},
+	{"access-token-ttl", "MESSENGER_ACCESS_TOKEN_TTL", "how long an access token lasts", false,
+		setString(func(cfg *config) *string { return &cfg.AccessTokenTTL })},
+	{"trusted-proxies", "MESSENGER_TRUSTED_PROXIES", "comma separated ips or CIDR ranges of proxies whose X-Forwarded-For is trusted", false,
+		setString(func(cfg *config) *string { return &cfg.TrustedProxies })},
+}
+
+//flagValue collects the value of a flag, so only flags actually given
+//override the config
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.isBool }
+
+//loadConfig builds the config from the command line arguments, the
+//environment and the config file, in that order of precedence
+func loadConfig(args []string) (config, error) {
+	cfg := defaultConfig
+
+	fs := flag.NewFlagSet("messenger-server", flag.ExitOnError)
+	path := fs.String("config", os.Getenv("MESSENGER_CONFIG"), "YAML config file")
+	flags := map[string]*flagValue{}
+	for _, v := range configVars {
+		flags[v.flag] = &flagValue{isBool: v.isBool}
+		fs.Var(flags[v.flag], v.flag, v.usage+" (env "+v.env+")")
+	}
+	migratePasswords := fs.Bool("migrate-passwords", false,
+		"hash all plaintext passwords in the storage backend and exit")
+	fs.Parse(args)
+	cfg.migratePasswords = *migratePasswords
+
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return cfg, err
+		}
+		if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, v := range configVars {
+		if e := os.Getenv(v.env); e != "" {
+			if err := v.set(&cfg, e); err != nil {
+				return cfg, errors.New("Invalid " + v.env + ": " + err.Error())
+			}
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, v := range configVars {
+		if set[v.flag] {
+			if err := v.set(&cfg, flags[v.flag].value); err != nil {
+				return cfg, errors.New("Invalid -" + v.flag + ": " + err.Error())
+			}
+		}
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, errors.New("Both or none of tls_cert and tls_key have to be set")
+	}
+	if _, err := cfg.sessionTTL(); err != nil {
+		return cfg, errors.New("Invalid session_ttl: " + err.Error())
+	}
+	if _, err := cfg.accessTokenTTL(); err != nil {
+		return cfg, errors.New("Invalid access_token_ttl: " + err.Error())
+	}
+	if _, err := cfg.keyring(); err != nil {
+		return cfg, errors.New("Invalid token_keys: " + err.Error())
+	}
+	if _, err := cfg.trustedProxies(); err != nil {
+		return cfg, errors.New("Invalid trusted_proxies: " + err.Error())
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,108 @@
+//Command messenger-server serves the messenger api outside App Engine
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/app"
+	"github.com/abhicnv007/messenger-server/handler"
+	"github.com/abhicnv007/messenger-server/storage"
+	"github.com/abhicnv007/messenger-server/storage/memory"
+	"github.com/abhicnv007/messenger-server/storage/sqlite"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("Could not load the config ", err)
+	}
+
+	s, closeStore, err := openStore(cfg)
+	if err != nil {
+		log.Fatal("Could not open the storage backend ", err)
+	}
+	defer closeStore()
+	storage.Use(s)
+
+	if cfg.migratePasswords {
+		n, err := user.MigratePasswords(context.Background())
+		log.Println("Hashed the passwords of", n, "users")
+		if err != nil {
+			closeStore()
+			log.Fatal(err)
+		}
+		return
+	}
+
+	app.SetLegacyLogin(cfg.LegacyLogin)
+	ttl, _ := cfg.sessionTTL()
+	app.SetSessionTTL(ttl)
+	ttl, _ = cfg.accessTokenTTL()
+	app.SetAccessTokenTTL(ttl)
+	if k, _ := cfg.keyring(); k != nil {
+		app.SetTokenKeyring(k)
+	}
+	if p, _ := cfg.trustedProxies(); p != nil {
+		app.SetRateLimitKey(handler.ForwardedIP(p))
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: app.NewRouter(),
+	}
+	srv.RegisterOnShutdown(app.Shutdown)
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		log.Println("Shutting down")
+		c, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(c); err != nil {
+			log.Println("Shutdown did not complete", err)
+		}
+		close(done)
+	}()
+
+	log.Println("Listening on", cfg.Addr)
+	if cfg.TLSCert != "" {
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-done
+}
+
+//openStore returns the configured storage backend and a func releasing it
+func openStore(cfg config) (storage.Store, func(), error) {
+	switch cfg.Storage {
+	case "memory":
+		return memory.New(), func() {}, nil
+	case "sqlite":
+		s, err := sqlite.Open(cfg.SQLitePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	}
+	return nil, nil, errors.New("Unknown storage backend " + cfg.Storage)
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+//BearerToken returns the token of the request's Authorization header if it
+//uses the Bearer scheme, the counterpart of http.Request.BasicAuth
+func BearerToken(r *http.Request) (token string, ok bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	token = strings.TrimSpace(auth[len(prefix):])
+	return token, token != ""
+}
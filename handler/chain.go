@@ -0,0 +1,39 @@
+package handler
+
+import "net/http"
+
+//Middleware wraps a handler with work done before and/or after it
+type Middleware func(http.Handler) http.Handler
+
+//Chain is a list of middleware, the first one being the outermost. It is
+//meant to group the middleware shared by a set of routes
+type Chain []Middleware
+
+//NewChain returns a chain of the given middleware
+func NewChain(mw ...Middleware) Chain {
+	return Chain(nil).Append(mw...)
+}
+
+//Append returns a new chain with mw added after the middleware of c, c itself
+//is left untouched
+func (c Chain) Append(mw ...Middleware) Chain {
+	n := make(Chain, 0, len(c)+len(mw))
+	n = append(n, c...)
+	return append(n, mw...)
+}
+
+//Then returns h wrapped in all the middleware of the chain
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+	return h
+}
+
+//New Returns a new handler running the middleware of the chain before the
+//authentication
+func (c Chain) New(fn func(w http.ResponseWriter, r *http.Request)) *Handler {
+	h := New(fn)
+	h.chain = c
+	return h
+}
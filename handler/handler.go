@@ -1,54 +1,108 @@
 package handler
 
 import "net/http"
+import "github.com/abhicnv007/messenger-server/auth"
 import "github.com/abhicnv007/messenger-server/response"
 
-//Handler is an object that is passed to the serve mux to handle routes
+//AuthFunc authenticates and/or authorises the request, the request is
+//rejected with StatusUnauthorized if it returns an error. Otherwise the
+//principal is attached to the context of the request, see auth.FromContext
+type AuthFunc func(w http.ResponseWriter, r *http.Request) (auth.Principal, error)
+
+//Handler is an object that is passed to the serve mux to handle routes.
+//A request goes through the global middleware, the middleware of the Chain
+//the handler was made from, the authentication, the middleware of the
+//handler itself and finally the MainHandler
 type Handler struct {
 
-	//AuthHandler Handles authentication and/or authorisation of the request
-	AuthHandler func(w http.ResponseWriter, r *http.Request) error
+	//AuthHandler Handles authentication and/or authorisation of the request,
+	//if nil the global auth function is used unless NoAuth was called
+	AuthHandler AuthFunc
 
 	//MainHandler Handles the actual work of the request
 	MainHandler func(w http.ResponseWriter, r *http.Request)
 
 	//	Values map[interface{}]interface{}
+
+	chain  Chain
+	route  Chain
+	noAuth bool
 }
 
-//SetGlobalAuthFunc sets the suth function for all handlers
-// NOTE: Has to ba called before creating any new handlers
-func SetGlobalAuthFunc(fn func(w http.ResponseWriter, r *http.Request) error) {
+//SetGlobalAuthFunc sets the auth function for all handlers, it is looked up
+//on every request so it does not matter if handlers were created before
+func SetGlobalAuthFunc(fn AuthFunc) {
 	rootAuthHandler = fn
 }
 
+//Use adds middleware run by all handlers before anything else, in the order
+//given. It is looked up on every request like the global auth function
+// NOTE: Has to be called before serving any requests
+func Use(mw ...Middleware) {
+	global = append(global, mw...)
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var err error
+	var inner http.Handler = http.HandlerFunc(h.serve)
+	inner = h.route.Then(inner)
+	if auth := h.auth(); auth != nil {
+		inner = authenticate(auth, inner)
+	}
+	inner = h.chain.Then(inner)
+	inner = Chain(global).Then(inner)
+
+	inner.ServeHTTP(w, r)
+}
 
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if h.MainHandler != nil {
+		h.MainHandler(w, r)
+	}
+}
+
+func (h *Handler) auth() AuthFunc {
+	if h.noAuth {
+		return nil
+	}
 	if h.AuthHandler != nil {
-		if err = h.AuthHandler(w, r); err != nil {
+		return h.AuthHandler
+	}
+	return rootAuthHandler
+}
+
+func authenticate(fn AuthFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := fn(w, r)
+		if err != nil {
 			response.New(w).WithCode(http.StatusUnauthorized).
 				Error(err.Error())
 			return
 		}
-	}
-
-	if h.MainHandler != nil {
-		h.MainHandler(w, r)
-	}
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), p)))
+	})
 }
 
 //NoAuth ensures the handler does not uthenticate the request
 func (h *Handler) NoAuth() *Handler {
+	h.noAuth = true
 	h.AuthHandler = nil
 	return h
 }
 
-var rootAuthHandler func(w http.ResponseWriter, r *http.Request) error
+//Use adds middleware run only by this handler, after the request has been
+//authenticated
+func (h *Handler) Use(mw ...Middleware) *Handler {
+	h.route = h.route.Append(mw...)
+	return h
+}
+
+var rootAuthHandler AuthFunc
+
+var global []Middleware
 
 //New Returns a new handler
 func New(fn func(w http.ResponseWriter, r *http.Request)) *Handler {
 	return &Handler{
-		AuthHandler: rootAuthHandler,
 		MainHandler: fn,
 	}
 }
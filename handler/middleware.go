@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abhicnv007/messenger-server/response"
+)
+
+//statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	//wrote is set once the header is sent, nothing can be changed after
+	wrote bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wrote {
+		s.status = code
+		s.wrote = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wrote = true
+	return s.ResponseWriter.Write(b)
+}
+
+//Flush lets streaming handlers flush through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Hijack lets handlers take over the connection through the recorder, as
+//WebSockets do
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	s.status = http.StatusSwitchingProtocols
+	s.wrote = true
+	return h.Hijack()
+}
+
+//Logging logs the method, path, status and duration of every request
+func Logging() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			log.Println(r.Method, r.URL.Path, rec.status, time.Since(start))
+		})
+	}
+}
+
+//Recovery responds with StatusInternalServerError instead of dropping the
+//connection when a handler panics. A response already under way cannot be
+//changed, so it is only cut short. http.ErrAbortHandler is panicked again,
+//it is how a handler asks for the connection to be dropped
+func Recovery() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Println("Panic serving", r.Method, r.URL.Path, err, string(debug.Stack()))
+				if !rec.wrote {
+					response.New(w).WithCode(http.StatusInternalServerError).
+						Error("Internal error")
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+//MaxBodySize makes reading more than n bytes of a request body fail
+func MaxBodySize(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				response.New(w).WithCode(http.StatusRequestEntityTooLarge).
+					Error("Body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//RemoteIP returns the ip the request came from, the key RateLimit uses by
+//default
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//ForwardedIP returns a key for RateLimit for servers behind proxies, all
+//requests of which would otherwise share the ip of the proxy. Requests from
+//one of the trusted proxies are keyed on the rightmost address of their
+//X-Forwarded-For header that is not a trusted proxy itself, as anything left
+//of it may have been sent by the client. Other requests are keyed on RemoteIP
+func ForwardedIP(trusted []*net.IPNet) func(r *http.Request) string {
+	isTrusted := func(s string) bool {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		ip := RemoteIP(r)
+		if !isTrusted(ip) {
+			return ip
+		}
+		hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !isTrusted(hop) {
+				return hop
+			}
+			ip = hop
+		}
+		//Only proxies, so the request was made by the last one
+		return ip
+	}
+}
+
+//bucket is a token bucket, holding up to burst tokens refilled at rate per
+//second
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//RateLimit allows each key, as returned by key, burst requests at once and
+//on average rate requests per second, rejecting the rest with
+//StatusTooManyRequests. Keys are the remote ip if key is nil
+func RateLimit(rate float64, burst int, key func(r *http.Request) string) Middleware {
+	if key == nil {
+		key = RemoteIP
+	}
+
+	var mu sync.Mutex
+	buckets := map[string]*bucket{}
+	//A bucket idle for this long is full again and can be dropped
+	idle := time.Duration(float64(burst) / rate * float64(time.Second))
+	lastSweep := time.Now()
+
+	allow := func(k string, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if now.Sub(lastSweep) > idle {
+			for bk, b := range buckets {
+				if now.Sub(b.last) > idle {
+					delete(buckets, bk)
+				}
+			}
+			lastSweep = now
+		}
+
+		b, ok := buckets[k]
+		if !ok {
+			b = &bucket{tokens: float64(burst)}
+			buckets[k] = b
+		} else {
+			b.tokens += now.Sub(b.last).Seconds() * rate
+			if b.tokens > float64(burst) {
+				b.tokens = float64(burst)
+			}
+		}
+		b.last = now
+
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allow(key(r), time.Now()) {
+				response.New(w).WithCode(http.StatusTooManyRequests).
+					Error("Too many requests")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
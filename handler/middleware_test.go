@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecovery(t *testing.T) {
+	h := Recovery()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("broken")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Got %d, want 500", w.Code)
+	}
+}
+
+func TestRecoveryAfterWriting(t *testing.T) {
+	h := Recovery()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("broken")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("Got %d %q, want the response cut short", w.Code, w.Body.String())
+	}
+}
+
+func TestRecoveryAbort(t *testing.T) {
+	h := Recovery()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("Got %v, want http.ErrAbortHandler panicked again", err)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestLoggingKeepsStreaming(t *testing.T) {
+	h := Logging()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Flusher hidden by the recorder")
+		}
+		w.Write([]byte("body"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestForwardedIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	key := ForwardedIP([]*net.IPNet{proxies})
+
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		//Not from a proxy, so the header is made up
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3", "10.0.0.3"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := key(r); got != tc.want {
+			t.Errorf("Got %q for %s forwarding %q, want %q", got, tc.remote, tc.forwarded, tc.want)
+		}
+	}
+}
+
+func TestRateLimitBehindProxy(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.1/32")
+	h := RateLimit(1, 1, ForwardedIP([]*net.IPNet{proxies}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(client string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := do("198.51.100.1"); code != http.StatusOK {
+		t.Errorf("Got %d for the first client, want 200", code)
+	}
+	if code := do("198.51.100.2"); code != http.StatusOK {
+		t.Errorf("Got %d for another client behind the same proxy, want 200", code)
+	}
+	if code := do("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("Got %d for the first client again, want 429", code)
+	}
+}
@@ -0,0 +1,160 @@
+//Package live keeps track of the clients connected to receive updates as they
+//happen and delivers frames to them, independent of how they are connected
+package live
+
+import (
+	"sync"
+)
+
+//sendBuffer is how many frames may be queued for a client before it is
+//considered too slow and dropped
+const sendBuffer = 64
+
+//Client is a single connection of a user
+type Client struct {
+	UID int64
+
+	send chan []byte
+
+	//muted are the threads the client unsubscribed from, guarded by the hub
+	muted map[int64]bool
+	//closed is set once send is closed, guarded by the hub
+	closed bool
+}
+
+//Send returns the frames to deliver to the client, it is closed once the
+//client is unregistered or dropped for not keeping up
+func (c *Client) Send() <-chan []byte {
+	return c.send
+}
+
+//Hub delivers frames to the clients of users, it is safe for concurrent use
+type Hub struct {
+	mu      sync.Mutex
+	clients map[int64]map[*Client]bool
+	//closed is set by Close, clients registered after get closed right away
+	closed bool
+	//done is closed by Close
+	done chan struct{}
+}
+
+//NewHub returns a hub without clients
+func NewHub() *Hub {
+	return &Hub{clients: map[int64]map[*Client]bool{}, done: make(chan struct{})}
+}
+
+//Done returns a channel that is closed once the hub is closed
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+//Register adds a client of the user, it gets frames of all threads until it
+//unsubscribes from them
+func (h *Hub) Register(uid int64) *Client {
+	c := &Client{
+		UID:   uid,
+		send:  make(chan []byte, sendBuffer),
+		muted: map[int64]bool{},
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		c.closed = true
+		close(c.send)
+		return c
+	}
+	cs, ok := h.clients[c.UID]
+	if !ok {
+		cs = map[*Client]bool{}
+		h.clients[c.UID] = cs
+	}
+	cs[c] = true
+	return c
+}
+
+//Unregister removes the client, closing its Send channel
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+func (h *Hub) remove(c *Client) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+
+	delete(h.clients[c.UID], c)
+	if len(h.clients[c.UID]) == 0 {
+		delete(h.clients, c.UID)
+	}
+}
+
+//Close unregisters every client, and any registered later, so their
+//connections end when the server shuts down
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		close(h.done)
+	}
+	h.closed = true
+	for _, cs := range h.clients {
+		for c := range cs {
+			h.remove(c)
+		}
+	}
+}
+
+//SendTo queues the frame for the client alone, like a reply to something it
+//sent. It is dropped if its queue is full, as with Publish
+func (h *Hub) SendTo(c *Client, frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- frame:
+	default:
+		h.remove(c)
+	}
+}
+
+//Subscribe makes the client get frames of the thread again
+func (h *Hub) Subscribe(c *Client, tid int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(c.muted, tid)
+}
+
+//Unsubscribe stops the client from getting frames of the thread
+func (h *Hub) Unsubscribe(c *Client, tid int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.muted[tid] = true
+}
+
+//Publish queues the frame about the thread for every client of the users not
+//unsubscribed from it. A client whose queue is full is dropped rather than
+//holding up everyone else
+func (h *Hub) Publish(uids []int64, tid int64, frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, uid := range uids {
+		for c := range h.clients[uid] {
+			if c.muted[tid] {
+				continue
+			}
+			select {
+			case c.send <- frame:
+			default:
+				h.remove(c)
+			}
+		}
+	}
+}
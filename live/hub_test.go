@@ -0,0 +1,62 @@
+package live
+
+import "testing"
+
+//closed reports whether the client was closed, draining its queued frames
+func closed(c *Client) bool {
+	for {
+		select {
+		case _, ok := <-c.Send():
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	h := NewHub()
+	a, b := h.Register(1), h.Register(2)
+	h.Unsubscribe(b, 10)
+
+	h.Publish([]int64{1, 2}, 10, []byte("x"))
+	if f := <-a.Send(); string(f) != "x" {
+		t.Errorf("Got %q", f)
+	}
+	select {
+	case f := <-b.Send():
+		t.Errorf("Unsubscribed client got %q", f)
+	default:
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	h := NewHub()
+	a := h.Register(1)
+	h.Publish([]int64{1}, 10, []byte("x"))
+
+	select {
+	case <-h.Done():
+		t.Error("Hub done before closing it")
+	default:
+	}
+	h.Close()
+	select {
+	case <-h.Done():
+	default:
+		t.Error("Hub not done after closing it")
+	}
+	//Closing again does not panic
+	h.Close()
+	if !closed(a) {
+		t.Error("Client still open after closing the hub")
+	}
+	if !closed(h.Register(1)) {
+		t.Error("Client registered after closing the hub is open")
+	}
+	//Does not panic on a closed client
+	h.Unregister(a)
+	h.Publish([]int64{1}, 10, []byte("x"))
+}
@@ -0,0 +1,273 @@
+package live
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Event is an update for a user, its ID lets a client resume right after it
+type Event struct {
+	ID   string
+	Type string
+	Data []byte
+
+	seq int64
+	//refs name what the event is about, for Redact
+	refs []string
+}
+
+func (e Event) about(ref string) bool {
+	for _, r := range e.refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+//Subscription gets the events of a user as they are appended to a Log
+type Subscription struct {
+	uid    int64
+	events chan Event
+	//closed is set once events is closed, guarded by the log
+	closed bool
+}
+
+//Events returns the events of the subscription, it is closed once the
+//subscription is cancelled or dropped for not keeping up. A dropped
+//subscriber can resume from the last event it got with a new subscription
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+type userLog struct {
+	events []Event
+	//trimmed is the seq of the latest event dropped from events
+	trimmed int64
+	subs    map[*Subscription]bool
+	//active is when the user last subscribed or unsubscribed, or when the
+	//log was made
+	active time.Time
+}
+
+//Log keeps the latest events of every user, so a client reconnecting with
+//the id of the last event it got receives everything it missed. It is safe
+//for concurrent use
+type Log struct {
+	mu sync.Mutex
+
+	//epoch tells the ids of this process apart from those of earlier runs,
+	//whose events are gone
+	epoch string
+	seq   int64
+	size  int
+	users map[int64]*userLog
+	//closed is set by Close, subscriptions made after are closed right away
+	closed bool
+
+	//idle is how long the events of a user without subscriptions are kept
+	idle      time.Duration
+	lastSweep time.Time
+}
+
+//NewLog returns a log keeping the latest size events of every user. Those of
+//a user without subscriptions for longer than idle are dropped, resuming
+//after that gets a reset
+func NewLog(size int, idle time.Duration) *Log {
+	return &Log{
+		epoch:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:      size,
+		users:     map[int64]*userLog{},
+		idle:      idle,
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *Log) user(uid int64) *userLog {
+	ul, ok := l.users[uid]
+	if !ok {
+		//Earlier events may have been dropped along with an idle log, so
+		//resuming from before now is not complete
+		ul = &userLog{trimmed: l.seq, subs: map[*Subscription]bool{}, active: time.Now()}
+		l.users[uid] = ul
+	}
+	return ul
+}
+
+//sweep drops the logs of the users idle for too long, at most once every idle
+func (l *Log) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idle {
+		return
+	}
+	for uid, ul := range l.users {
+		if len(ul.subs) == 0 && now.Sub(ul.active) > l.idle {
+			delete(l.users, uid)
+		}
+	}
+	l.lastSweep = now
+}
+
+//Append adds an event for every one of the users and hands it to their
+//subscriptions. refs name what the event is about, so its data can be
+//replaced later with Redact
+func (l *Log) Append(uids []int64, typ string, data []byte, refs ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(time.Now())
+
+	l.seq++
+	e := Event{
+		ID:   l.epoch + "-" + strconv.FormatInt(l.seq, 10),
+		Type: typ,
+		Data: data,
+		seq:  l.seq,
+		refs: refs,
+	}
+
+	for _, uid := range uids {
+		ul := l.user(uid)
+		ul.events = append(ul.events, e)
+		if len(ul.events) > l.size {
+			ul.trimmed = ul.events[0].seq
+			ul.events = append([]Event(nil), ul.events[1:]...)
+		}
+
+		for s := range ul.subs {
+			select {
+			case s.events <- e:
+			default:
+				l.cancel(s)
+			}
+		}
+	}
+}
+
+//Redact replaces the data of the kept events of the users about ref with what
+//fn returns for them, so content removed since is not resent to a client
+//resuming. fn is called once for each event
+func (l *Log) Redact(uids []int64, ref string, fn func(e Event) []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	redacted := map[int64][]byte{}
+	for _, uid := range uids {
+		ul, ok := l.users[uid]
+		if !ok {
+			continue
+		}
+		for i, e := range ul.events {
+			if !e.about(ref) {
+				continue
+			}
+			d, ok := redacted[e.seq]
+			if !ok {
+				d = fn(e)
+				redacted[e.seq] = d
+			}
+			ul.events[i].Data = d
+		}
+	}
+}
+
+//Broadcast hands an event to the current subscriptions of the users without
+//keeping it, for updates not worth resuming from. The event has no ID, so it
+//does not move where a client resumes
+func (l *Log) Broadcast(uids []int64, typ string, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := Event{Type: typ, Data: data}
+	for _, uid := range uids {
+		ul, ok := l.users[uid]
+		if !ok {
+			continue
+		}
+		for s := range ul.subs {
+			select {
+			case s.events <- e:
+			default:
+				l.cancel(s)
+			}
+		}
+	}
+}
+
+//Subscribe starts getting the events of the user. If lastID is the id of an
+//event the client got before, the events after it are returned as missed,
+//and complete reports whether all of them were still kept
+func (l *Log) Subscribe(uid int64, lastID string) (s *Subscription, missed []Event, complete bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s = &Subscription{uid: uid, events: make(chan Event, sendBuffer)}
+	if l.closed {
+		s.closed = true
+		close(s.events)
+		return s, nil, true
+	}
+	ul := l.user(uid)
+	ul.subs[s] = true
+	ul.active = time.Now()
+
+	if lastID == "" {
+		return s, nil, true
+	}
+
+	last, ok := l.parseID(lastID)
+	if !ok {
+		return s, append([]Event(nil), ul.events...), false
+	}
+	for _, e := range ul.events {
+		if e.seq > last {
+			missed = append(missed, e)
+		}
+	}
+	return s, missed, last >= ul.trimmed
+}
+
+//parseID returns the seq of an id handed out by this log
+func (l *Log) parseID(id string) (int64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != l.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil || seq > l.seq {
+		return 0, false
+	}
+	return seq, true
+}
+
+//Close cancels every subscription, and any made later, so the streams end
+//when the server shuts down
+func (l *Log) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for _, ul := range l.users {
+		for s := range ul.subs {
+			l.cancel(s)
+		}
+	}
+}
+
+//Unsubscribe stops the subscription, closing its Events channel
+func (l *Log) Unsubscribe(s *Subscription) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancel(s)
+}
+
+func (l *Log) cancel(s *Subscription) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+	ul := l.users[s.uid]
+	delete(ul.subs, s)
+	ul.active = time.Now()
+}
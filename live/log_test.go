@@ -0,0 +1,69 @@
+package live
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogClose(t *testing.T) {
+	l := NewLog(8, time.Hour)
+	s, _, _ := l.Subscribe(1, "")
+
+	l.Close()
+	if _, ok := <-s.Events(); ok {
+		t.Error("Subscription still open after closing the log")
+	}
+	s2, _, _ := l.Subscribe(1, "")
+	if _, ok := <-s2.Events(); ok {
+		t.Error("Subscription made after closing the log is open")
+	}
+	l.Unsubscribe(s)
+	l.Unsubscribe(s2)
+	l.Append([]int64{1}, "x", nil)
+}
+
+func TestLogRedact(t *testing.T) {
+	l := NewLog(8, time.Hour)
+	l.Append([]int64{1, 2}, "new", []byte("secret"), "m1")
+	l.Append([]int64{1, 2}, "new", []byte("other"), "m2")
+
+	calls := 0
+	l.Redact([]int64{1, 2}, "m1", func(e Event) []byte {
+		calls++
+		return []byte("gone")
+	})
+	if calls != 1 {
+		t.Errorf("Redacted %d times, want once for the event shared by both users", calls)
+	}
+
+	for _, uid := range []int64{1, 2} {
+		s, missed, _ := l.Subscribe(uid, l.epoch+"-0")
+		if len(missed) != 2 || string(missed[0].Data) != "gone" || string(missed[1].Data) != "other" {
+			t.Errorf("User %d resumed with %+v", uid, missed)
+		}
+		l.Unsubscribe(s)
+	}
+}
+
+func TestLogDropsIdleUsers(t *testing.T) {
+	l := NewLog(8, 10*time.Millisecond)
+	l.Append([]int64{1}, "new", nil)
+	s, _, _ := l.Subscribe(2, "")
+	defer l.Unsubscribe(s)
+
+	time.Sleep(20 * time.Millisecond)
+	//Sweeps the log of user 1, not that of user 2 who is subscribed
+	l.Append([]int64{2}, "new", nil)
+	if _, ok := l.users[1]; ok {
+		t.Fatal("Idle log kept")
+	}
+	if _, ok := l.users[2]; !ok {
+		t.Fatal("Log of a subscribed user dropped")
+	}
+
+	s1, missed, complete := l.Subscribe(1, l.epoch+"-1")
+	defer l.Unsubscribe(s1)
+	if complete || len(missed) != 0 {
+		t.Errorf("Resumed a dropped log with %+v, complete %v", missed, complete)
+	}
+}
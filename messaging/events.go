@@ -0,0 +1,170 @@
+package messaging
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+//Event is a change to the threads or messages, published after it is stored.
+//It is one of ThreadCreated, MessageInserted, MessageEdited, MessageDeleted,
+//ReactionsChanged, MessagesRead or ParticipantsAdded, or Typing which is
+//published without storing anything
+type Event interface {
+	//Participants are the users of the thread who see the change
+	Participants() []int64
+}
+
+//ThreadCreated is published by NewThread
+type ThreadCreated struct {
+	Thread Thread
+}
+
+//MessageInserted is published by InsertMessage, and by InsertReply with
+//Message.Root set
+type MessageInserted struct {
+	Thread  Thread
+	Message Message
+}
+
+//MessageEdited is published by EditMessage
+type MessageEdited struct {
+	Thread  Thread
+	Message Message
+
+	hiddenFor []int64
+}
+
+//MessageDeleted is published by DeleteMessage, Message is the tombstone
+type MessageDeleted struct {
+	Thread   Thread
+	Message  Message
+	UID      int64
+	Everyone bool
+}
+
+//ReactionsChanged is published by AddReaction and RemoveReaction, Message has
+//all the reactions after the change
+type ReactionsChanged struct {
+	Thread  Thread
+	Message Message
+
+	hiddenFor []int64
+}
+
+//MessagesRead is published by MarkRead when the marker moved
+type MessagesRead struct {
+	Thread Thread
+	Marker ReadMarker
+}
+
+//ParticipantsAdded is published by AddParticipants when anyone was added
+type ParticipantsAdded struct {
+	Thread Thread
+	Added  []int64
+}
+
+//Participants of the created thread
+func (e ThreadCreated) Participants() []int64 { return e.Thread.Participants }
+
+//Participants of the thread the message was inserted in
+func (e MessageInserted) Participants() []int64 { return e.Thread.Participants }
+
+//Participants of the thread the message was edited in, but those who deleted
+//it for themselves
+func (e MessageEdited) Participants() []int64 {
+	return notHidden(e.Thread.Participants, e.hiddenFor)
+}
+
+//Participants of the thread of the message, but those who deleted it for
+//themselves
+func (e ReactionsChanged) Participants() []int64 {
+	return notHidden(e.Thread.Participants, e.hiddenFor)
+}
+
+func notHidden(participants []int64, hiddenFor []int64) []int64 {
+	uids := make([]int64, 0, len(participants))
+	for _, uid := range participants {
+		if !(Message{HiddenFor: hiddenFor}).IsDeletedFor(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+//Participants of the thread if the message was deleted for everyone, else
+//only the user who deleted it
+func (e MessageDeleted) Participants() []int64 {
+	if e.Everyone {
+		return e.Thread.Participants
+	}
+	return []int64{e.UID}
+}
+
+//Participants of the thread the marker moved in
+func (e MessagesRead) Participants() []int64 { return e.Thread.Participants }
+
+//Participants of the thread, including the ones added
+func (e ParticipantsAdded) Participants() []int64 { return e.Thread.Participants }
+
+//Subscriber gets every event published. It runs as part of the request making
+//the change, so it must not block; slow work should be handed off
+type Subscriber func(c context.Context, e Event)
+
+type subscription struct {
+	id int
+	fn Subscriber
+}
+
+var bus struct {
+	sync.RWMutex
+	lastID int
+	subs   []subscription
+}
+
+//Subscribe adds fn to the subscribers of every event and returns the func
+//that removes it again
+func Subscribe(fn Subscriber) (unsubscribe func()) {
+	bus.Lock()
+	defer bus.Unlock()
+	bus.lastID++
+	id := bus.lastID
+	bus.subs = append(bus.subs, subscription{id, fn})
+
+	return func() {
+		bus.Lock()
+		defer bus.Unlock()
+		for i, s := range bus.subs {
+			if s.id == id {
+				//Copied so a publish in progress keeps its own slice
+				subs := make([]subscription, 0, len(bus.subs)-1)
+				subs = append(subs, bus.subs[:i]...)
+				bus.subs = append(subs, bus.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+//publish calls every subscriber with e, in the order they subscribed. A
+//subscriber panicking is logged and does not stop the others
+func publish(c context.Context, e Event) {
+	bus.RLock()
+	subs := bus.subs
+	bus.RUnlock()
+
+	for _, s := range subs {
+		deliver(c, s.fn, e)
+	}
+}
+
+func deliver(c context.Context, fn Subscriber, e Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Event subscriber panicked on %T: %v\n%s", e, err, debug.Stack())
+		}
+	}()
+	fn(c, e)
+}
@@ -4,10 +4,24 @@ import (
 	"log"
 
 	"errors"
+	"time"
 
 	"golang.org/x/net/context"
+)
 
-	"google.golang.org/appengine/datastore"
+var (
+	//ErrNotSender is returned when changing a message sent by someone else
+	ErrNotSender = errors.New("Not the sender of the message")
+	//ErrDeleted is returned when changing a message deleted for everyone, or
+	//reacting to one deleted for oneself
+	ErrDeleted = errors.New("The message was deleted")
+	//ErrReplyNotFound is returned when replying to a message not in the thread
+	ErrReplyNotFound = errors.New("No such message to reply to")
+	//ErrNotParticipant is returned when a user changes a thread they are not in
+	ErrNotParticipant = errors.New("Not a participant of the thread")
+	//ErrRootNotFound is returned when adding to the sub-thread of a message
+	//not in the thread
+	ErrRootNotFound = errors.New("No such message to start a sub-thread of")
 )
 
 //Message Type for storing IMs
@@ -17,12 +31,189 @@ type Message struct {
 	From         int64  `json:"from"`
 	Content      string `json:"content"`
 	Time         string `json:"time"`
+	//Edited is when the content was last changed, empty if it never was
+	Edited string `json:"edited"`
+	//Revisions are the earlier contents of the message, oldest first
+	Revisions []Revision `json:"revisions" datastore:",noindex"`
+	//Deleted is when the message was deleted for everyone, empty if it was not
+	Deleted string `json:"deleted"`
+	//HiddenFor are the users who deleted the message for themselves
+	HiddenFor []int64 `json:"hiddenfor" datastore:",noindex"`
+	//Reactions are in the order they were added
+	Reactions []Reaction `json:"reactions" datastore:",noindex"`
+	//ReplyTo is the id of the message in the same thread this one replies to,
+	//0 if it is not a reply
+	ReplyTo int64 `json:"replyto"`
+	//Quoted is the message replied to, it is loaded along with the message by
+	//this package and never stored
+	Quoted *Message `json:"-" datastore:"-"`
+
+	//Root is the id of the message this is in the sub-thread of, 0 for the
+	//messages of the thread itself
+	Root int64 `json:"root"`
+	//ReplyCount is the number of messages in the sub-thread of this one
+	ReplyCount int `json:"replycount" datastore:",noindex"`
+	//LastReply is the Time of the latest message in the sub-thread
+	LastReply string `json:"lastreply" datastore:",noindex"`
+}
+
+//Reaction is an emoji a user reacted to a message with
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	UID   int64  `json:"uid"`
+}
+
+//IsDeletedFor reports if uid sees the message as deleted
+func (m Message) IsDeletedFor(uid int64) bool {
+	if m.Deleted != "" {
+		return true
+	}
+	for _, h := range m.HiddenFor {
+		if h == uid {
+			return true
+		}
+	}
+	return false
+}
+
+//VisibleTo returns the message as uid sees it, without whom else it is hidden
+//for. If it is deleted for them it is a tombstone keeping only the ids, sender
+//and time, and HiddenFor is uid unless it is deleted for everyone
+func (m Message) VisibleTo(uid int64) Message {
+	if !m.IsDeletedFor(uid) {
+		m.HiddenFor = nil
+		if m.Quoted != nil {
+			q := m.Quoted.VisibleTo(uid)
+			m.Quoted = &q
+		}
+		return m
+	}
+	var hidden []int64
+	if m.Deleted == "" {
+		hidden = []int64{uid}
+	}
+	return Message{
+		ParentThread: m.ParentThread,
+		MessageID:    m.MessageID,
+		From:         m.From,
+		Time:         m.Time,
+		Deleted:      m.Deleted,
+		HiddenFor:    hidden,
+	}
+}
+
+//Revision is the content of a message before it was edited
+type Revision struct {
+	Content string `json:"content"`
+	//Time is when the content was written, the Time of the message or when it
+	//was edited before
+	Time string `json:"time"`
 }
 
 //Thread represents a conversation
 type Thread struct {
 	ThreadID     int64   `json:"threadid"`
 	Participants []int64 `json:"participants"`
+	//ReadMarkers are how far each participant has read, one per participant
+	//who read anything
+	ReadMarkers []ReadMarker `json:"readmarkers" datastore:",noindex"`
+	//DeliveryMarkers are the latest message each participant's clients got,
+	//one per participant who got anything
+	DeliveryMarkers []ReadMarker `json:"deliverymarkers" datastore:",noindex"`
+	//LastMessageID is the id of the latest message, 0 if there is none
+	LastMessageID int64 `json:"lastmessageid" datastore:",noindex"`
+	//LastActivity is when the thread was created or last got a message, in
+	//RFC3339 as the server saw it
+	LastActivity string `json:"lastactivity" datastore:",noindex"`
+}
+
+//ReadMarker is the latest message of the thread a user has read, or got
+//delivered for the DeliveryMarkers of a thread
+type ReadMarker struct {
+	UID       int64 `json:"uid"`
+	MessageID int64 `json:"messageid"`
+	//Time is the Time of the message, messages are ordered by it
+	Time string `json:"time"`
+}
+
+//before reports if the message at time t with the id mid comes before the
+//marker, in the order messages are listed in
+func (r ReadMarker) before(t string, mid int64) bool {
+	if t == r.Time {
+		return mid < r.MessageID
+	}
+	return t < r.Time
+}
+
+//covers reports if the message at time t with the id mid is the one of the
+//marker or comes before it
+func (r ReadMarker) covers(t string, mid int64) bool {
+	return r.before(t, mid) || (t == r.Time && mid == r.MessageID)
+}
+
+func (t *Thread) setReadMarker(r ReadMarker) {
+	t.ReadMarkers = setMarker(t.ReadMarkers, r)
+}
+
+func setMarker(rs []ReadMarker, r ReadMarker) []ReadMarker {
+	for i := range rs {
+		if rs[i].UID == r.UID {
+			rs[i] = r
+			return rs
+		}
+	}
+	return append(rs, r)
+}
+
+func findMarker(rs []ReadMarker, uid int64) (ReadMarker, bool) {
+	for _, r := range rs {
+		if r.UID == uid {
+			return r, true
+		}
+	}
+	return ReadMarker{UID: uid}, false
+}
+
+//ReadMarker returns the marker of uid, and false if they have not read
+//anything yet
+func (t Thread) ReadMarker(uid int64) (ReadMarker, bool) {
+	return findMarker(t.ReadMarkers, uid)
+}
+
+//Status of a message for one of its recipients
+const (
+	//StatusSent is a message stored but not yet got by the recipient
+	StatusSent = "sent"
+	//StatusDelivered is a message fetched by a client of the recipient
+	StatusDelivered = "delivered"
+	//StatusRead is a message the recipient has read
+	StatusRead = "read"
+)
+
+//Receipt is the status of a message for one of its recipients
+type Receipt struct {
+	UID    int64
+	Status string
+}
+
+//Receipts returns the status of the message for every participant but its
+//sender. Markers only move forward, so a message is delivered or read once
+//the marker is at it or any later message
+func (t Thread) Receipts(m Message) []Receipt {
+	var rs []Receipt
+	for _, uid := range t.Participants {
+		if uid == m.From {
+			continue
+		}
+		r := Receipt{UID: uid, Status: StatusSent}
+		if mk, ok := findMarker(t.ReadMarkers, uid); ok && mk.covers(m.Time, m.MessageID) {
+			r.Status = StatusRead
+		} else if mk, ok := findMarker(t.DeliveryMarkers, uid); ok && mk.covers(m.Time, m.MessageID) {
+			r.Status = StatusDelivered
+		}
+		rs = append(rs, r)
+	}
+	return rs
 }
 
 //CheckIfParticipant Returns true if i in the participants
@@ -39,132 +230,590 @@ func (t *Thread) CheckIfParticipant(i int64) bool {
 type AllThreads struct {
 	UserID  int64   `json:"userid"`
 	Threads []int64 `json:"threads"`
+	//Unread is the number of unread messages of each of the Threads, it may be
+	//shorter than Threads for an index stored before it was kept
+	Unread []int `json:"unread" datastore:",noindex"`
+	//Activity is the LastActivity of each of the Threads, kept here so they
+	//can be ordered without getting every thread. It may be shorter than
+	//Threads as well
+	Activity []string `json:"activity" datastore:",noindex"`
+}
+
+func (con *AllThreads) add(tid int64, activity string) {
+	con.Threads = append(con.Threads, tid)
+	con.setUnread(tid, 0)
+	con.setActivity(tid, activity)
+}
+
+//ActivityIn returns the LastActivity of the thread
+func (con AllThreads) ActivityIn(tid int64) string {
+	for i, t := range con.Threads {
+		if t == tid && i < len(con.Activity) {
+			return con.Activity[i]
+		}
+	}
+	return ""
+}
+
+func (con *AllThreads) setActivity(tid int64, a string) {
+	for len(con.Activity) < len(con.Threads) {
+		con.Activity = append(con.Activity, "")
+	}
+	for i, t := range con.Threads {
+		if t == tid {
+			con.Activity[i] = a
+		}
+	}
+}
+
+//UnreadIn returns the number of unread messages in the thread
+func (con AllThreads) UnreadIn(tid int64) int {
+	for i, t := range con.Threads {
+		if t == tid && i < len(con.Unread) {
+			return con.Unread[i]
+		}
+	}
+	return 0
+}
+
+//TotalUnread returns the number of unread messages in all threads
+func (con AllThreads) TotalUnread() int {
+	n := 0
+	for _, u := range con.Unread {
+		n += u
+	}
+	return n
+}
+
+func (con *AllThreads) setUnread(tid int64, n int) {
+	for len(con.Unread) < len(con.Threads) {
+		con.Unread = append(con.Unread, 0)
+	}
+	for i, t := range con.Threads {
+		if t == tid {
+			con.Unread[i] = n
+		}
+	}
+}
+
+//now is the current time as stored in messages and threads
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
 }
 
 //NewThread Creates a new thread
 func NewThread(c context.Context, t Thread) (Thread, error) {
 
-	l, _, err := datastore.AllocateIDs(c, "Thread", nil, 1)
+	l, err := store.AllocateThreadID(c)
 	if err != nil {
 		log.Println(err)
 		return t, err
 	}
-	//Add the thread to the datastore
-	k := datastore.NewKey(c, "Thread", "", l, nil)
+	//Add the thread to the store
 	t.ThreadID = l
-	key, err := datastore.Put(c, k, &t)
-	if err != nil {
+	t.LastActivity = now()
+	if err = store.PutThread(c, t); err != nil {
 		log.Print("Put thread failed ", err)
 		return t, err
 	}
 
-	var keys []*datastore.Key
-	var lc []*AllThreads
 	//Add the thread to all Conversations maintained by the Participants
 	for _, p := range t.Participants {
-		var con AllThreads
-
-		k = datastore.NewKey(c, "AllThreads", "", p, nil)
-
-		if err := datastore.Get(c, k, &con); err != nil {
-			con.UserID = p
-			con.Threads = []int64{key.IntID()}
-		} else {
-			con.Threads = append(con.Threads, key.IntID())
+		err = store.UpdateAllThreads(c, p, func(con *AllThreads) error {
+			con.add(t.ThreadID, t.LastActivity)
+			return nil
+		})
+		if err != nil {
+			log.Print("Put failed", err)
+			return t, err
 		}
-
-		keys = append(keys, k)
-		lc = append(lc, &con)
-
-	}
-
-	if _, err := datastore.PutMulti(c, keys, lc); err != nil {
-		log.Print("Put failed", err)
-		return t, err
 	}
 
+	publish(c, ThreadCreated{Thread: t})
 	return t, nil
 
 }
 
-//GetAllThreads gets all threads that the user participates in
-func GetAllThreads(c context.Context, participant int64) ([]int64, error) {
-	k := datastore.NewKey(c, "AllThreads", "", participant, nil)
-	var con AllThreads
-	if err := datastore.Get(c, k, &con); err == datastore.ErrNoSuchEntity {
-		return nil, err
+//AddParticipants adds the users to the thread, ignoring those already in it,
+//and returns the thread along with the users actually added
+func AddParticipants(c context.Context, tid int64, uids []int64) (Thread, []int64, error) {
+	var t Thread
+	var added []int64
+	err := store.UpdateThread(c, tid, func(nt *Thread) error {
+		added = nil
+		for _, uid := range uids {
+			if !nt.CheckIfParticipant(uid) {
+				nt.Participants = append(nt.Participants, uid)
+				added = append(added, uid)
+			}
+		}
+		t = *nt
+		return nil
+	})
+	if err != nil {
+		return t, nil, err
 	}
 
-	return con.Threads, nil
+	for _, p := range added {
+		err = store.UpdateAllThreads(c, p, func(con *AllThreads) error {
+			con.add(tid, t.LastActivity)
+			return nil
+		})
+		if err != nil {
+			log.Print("Put failed", err)
+			return t, added, err
+		}
+	}
+
+	if len(added) != 0 {
+		publish(c, ParticipantsAdded{Thread: t, Added: added})
+	}
+	return t, added, nil
+}
 
+//GetAllThreads gets all threads that the user participates in, with the
+//unread count of each
+func GetAllThreads(c context.Context, participant int64) (AllThreads, error) {
+	return store.GetAllThreads(c, participant)
 }
 
 //GetThread gets the thread with the given threadID
 func GetThread(c context.Context, tid int64) (Thread, error) {
-	//q := datastore.NewQuery("Thread").Filter("ThreadID =", tid)
-	k := datastore.NewKey(c, "Thread", "", tid, nil)
-	//datastore.AllocateIDs(c, kind, parent, n)
-	var t Thread
-	datastore.Get(c, k, &t)
-	return t, nil
+	return store.GetThread(c, tid)
 }
 
-//GetMessage gets single message
+//GetMessage gets single message, it returns ErrNotFound if there is no such
+//message in the thread
 func GetMessage(c context.Context, tid int64, mid int64) (Message, error) {
-	key := datastore.NewKey(c, "Message", "", mid, getThreadKey(c, tid))
-	var msg Message
-	if err := datastore.Get(c, key, &msg); err != nil {
-		return msg, errors.New("No such message found")
+	msg, err := store.GetMessage(c, tid, mid)
+	if err != nil {
+		return msg, err
 	}
-	return msg, nil
+	return withQuote(c, msg)
+}
+
+//withQuote loads the message m replies to, if any, into m.Quoted
+func withQuote(c context.Context, m Message) (Message, error) {
+	ms, err := withQuotes(c, []Message{m})
+	return ms[0], err
+}
+
+//withQuotes loads the messages replied to into Quoted, a message no longer
+//there is left nil
+func withQuotes(c context.Context, ms []Message) ([]Message, error) {
+	quoted := map[int64]*Message{}
+	for i, m := range ms {
+		if m.ReplyTo == 0 {
+			continue
+		}
+		q, ok := quoted[m.ReplyTo]
+		if !ok {
+			qm, err := store.GetMessage(c, m.ParentThread, m.ReplyTo)
+			if err == nil {
+				q = &qm
+			} else if err != ErrNotFound {
+				return ms, err
+			}
+			quoted[m.ReplyTo] = q
+		}
+		ms[i].Quoted = q
+	}
+	return ms, nil
 }
 
 //GetMessages Gets messages from storage
 func GetMessages(c context.Context, tid int64, t string, num int) ([]Message, error) {
+	q, err := messagesQuery(t, num)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := store.QueryMessages(c, tid, q)
+	if err != nil {
+		return nil, err
+	}
+	return withQuotes(c, ms)
+}
+
+//GetReplies gets the messages in the sub-thread of the message root, t and
+//num work the same as for GetMessages
+func GetReplies(c context.Context, tid int64, root int64, t string, num int) ([]Message, error) {
+	q, err := messagesQuery(t, num)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := store.QueryReplies(c, tid, root, q)
+	if err != nil {
+		return nil, err
+	}
+	return withQuotes(c, ms)
+}
+
+//messagesQuery gets the latest num messages, or the ones after t
+func messagesQuery(t string, num int) (Query, error) {
 	if num == 0 && t == "" {
-		var m []Message
-		_, err := datastore.NewQuery("Message").Ancestor(getThreadKey(c, tid)).
-			Limit(10).Order("-Time").GetAll(c, &m)
-		return m, err
+		return Query{Limit: 10, Desc: true}, nil
 	} else if num == 0 {
-		var m []Message
-		_, err := datastore.NewQuery("Message").Ancestor(getThreadKey(c, tid)).
-			Filter("Time >", t).Limit(10).GetAll(c, &m)
-		return m, err
+		return Query{After: t, Limit: 10}, nil
 	} else if t == "" {
-		var m []Message
-		_, err := datastore.NewQuery("Message").Ancestor(getThreadKey(c, tid)).
-			Limit(num).Order("-Time").GetAll(c, &m)
-		return m, err
+		return Query{Limit: num, Desc: true}, nil
 	}
-	return nil, errors.New("Invalid Input")
-}
-
-func getThreadKey(c context.Context, tid int64) *datastore.Key {
-	return datastore.NewKey(c, "Thread", "", tid, nil)
+	return Query{}, errors.New("Invalid Input")
 }
 
 //InsertMessage inserts message
 func InsertMessage(c context.Context, m *Message) error {
 	//Get the parent thread first, then add the message
-	k := datastore.NewKey(c, "Thread", "", m.ParentThread, nil)
-	var t Thread
 
 	//[TODO Return errors to correspond with the HTTP Error codes]
-	if err := datastore.Get(c, k, &t); err == datastore.ErrNoSuchEntity {
+	t, err := store.GetThread(c, m.ParentThread)
+	if err != nil {
 		return err
 	}
-	l, _, err := datastore.AllocateIDs(c, "Message", k, 1)
+
+	var quoted *Message
+	if m.ReplyTo != 0 {
+		q, err := store.GetMessage(c, m.ParentThread, m.ReplyTo)
+		if err == ErrNotFound {
+			return ErrReplyNotFound
+		} else if err != nil {
+			return err
+		}
+		quoted = &q
+	}
+
+	l, err := store.AllocateMessageID(c, m.ParentThread)
 
 	if err != nil {
 		return err
 	}
 
 	//[TODO Hopefully change this and make the message ids linear for a thread]
-	key := datastore.NewKey(c, "Message", "", l, k)
 	m.MessageID = l
-	//Set the parent key k
-	datastore.Put(c, key, m)
+	m.Quoted = nil
+	if err = store.PutMessage(c, *m); err != nil {
+		return err
+	}
+	m.Quoted = quoted
+
+	activity := now()
+	err = store.UpdateThread(c, t.ThreadID, func(nt *Thread) error {
+		nt.LastMessageID, nt.LastActivity = m.MessageID, activity
+		t = *nt
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range t.Participants {
+		err = store.UpdateAllThreads(c, p, func(con *AllThreads) error {
+			con.setActivity(t.ThreadID, activity)
+			if p != m.From {
+				con.setUnread(t.ThreadID, con.UnreadIn(t.ThreadID)+1)
+			}
+			return nil
+		})
+		if err != nil {
+			//The message is stored, a wrong count is fixed by the next read
+			log.Print("Unread count update failed", err)
+		}
+	}
+
+	stopTyping(t.ThreadID, m.From)
+	publish(c, MessageInserted{Thread: t, Message: m.VisibleTo(0)})
+	return nil
+}
+
+//InsertReply adds the message to the sub-thread of the message m.Root, which
+//has to be one of the thread itself, and counts it on the root
+func InsertReply(c context.Context, m *Message) error {
+	t, err := store.GetThread(c, m.ParentThread)
+	if err != nil {
+		return err
+	}
+
+	root, err := store.GetMessage(c, m.ParentThread, m.Root)
+	if err == ErrNotFound {
+		return ErrRootNotFound
+	} else if err != nil {
+		return err
+	}
+	//Sub-threads are not nested
+	if root.Root != 0 {
+		return ErrRootNotFound
+	}
+	if root.Deleted != "" {
+		return ErrDeleted
+	}
+
+	var quoted *Message
+	if m.ReplyTo != 0 {
+		q, err := store.GetMessage(c, m.ParentThread, m.ReplyTo)
+		if err == ErrNotFound {
+			return ErrReplyNotFound
+		} else if err != nil {
+			return err
+		}
+		quoted = &q
+	}
 
+	if m.MessageID, err = store.AllocateMessageID(c, m.ParentThread); err != nil {
+		return err
+	}
+	m.Quoted = nil
+	if err = store.PutReply(c, *m); err != nil {
+		return err
+	}
+	m.Quoted = quoted
+
+	//Counted after the reply is stored, so a failure in between undercounts
+	//instead of counting a reply that is not there
+	err = store.UpdateMessage(c, m.ParentThread, m.Root, func(r *Message) error {
+		r.ReplyCount++
+		if m.Time > r.LastReply {
+			r.LastReply = m.Time
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stopTyping(t.ThreadID, m.From)
+	publish(c, MessageInserted{Thread: t, Message: m.VisibleTo(0)})
 	return nil
 }
+
+//EditMessage replaces the content of a message sent by uid, keeping the
+//earlier content as a revision
+func EditMessage(c context.Context, tid int64, mid int64, uid int64, content string) (Message, error) {
+	var m Message
+	edited := now()
+	err := store.UpdateMessage(c, tid, mid, func(nm *Message) error {
+		if nm.From != uid {
+			return ErrNotSender
+		}
+		if nm.Deleted != "" {
+			return ErrDeleted
+		}
+		if nm.Content != content {
+			written := nm.Time
+			if nm.Edited != "" {
+				written = nm.Edited
+			}
+			nm.Revisions = append(nm.Revisions, Revision{Content: nm.Content, Time: written})
+			nm.Content = content
+			nm.Edited = edited
+		}
+		m = *nm
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	t, err := store.GetThread(c, tid)
+	if err != nil {
+		return m, err
+	}
+	if m, err = withQuote(c, m); err != nil {
+		return m, err
+	}
+	publish(c, MessageEdited{Thread: t, Message: m.VisibleTo(0), hiddenFor: m.HiddenFor})
+	return m, nil
+}
+
+//DeleteMessage deletes the message for uid, or for everyone in the thread.
+//Only the sender can delete it for everyone, which purges its content,
+//revisions and reactions and leaves a tombstone in its place
+func DeleteMessage(c context.Context, tid int64, mid int64, uid int64, everyone bool) (Message, error) {
+	var m Message
+	deleted := now()
+	err := store.UpdateMessage(c, tid, mid, func(nm *Message) error {
+		if everyone {
+			if nm.From != uid {
+				return ErrNotSender
+			}
+			if nm.Deleted == "" {
+				nm.Deleted = deleted
+			}
+			nm.Content, nm.Edited, nm.Revisions, nm.Reactions = "", "", nil, nil
+		} else if !nm.IsDeletedFor(uid) {
+			nm.HiddenFor = append(nm.HiddenFor, uid)
+		}
+		m = *nm
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	t, err := store.GetThread(c, tid)
+	if err != nil {
+		return m, err
+	}
+	if m, err = withQuote(c, m); err != nil {
+		return m, err
+	}
+	publish(c, MessageDeleted{Thread: t, Message: m.VisibleTo(uid), UID: uid, Everyone: everyone})
+	return m, nil
+}
+
+//AddReaction reacts to the message with the emoji as uid, reacting twice with
+//the same emoji does nothing
+func AddReaction(c context.Context, tid int64, mid int64, uid int64, emoji string) (Message, error) {
+	return updateReactions(c, tid, mid, uid, func(m *Message) {
+		for _, r := range m.Reactions {
+			if r.Emoji == emoji && r.UID == uid {
+				return
+			}
+		}
+		m.Reactions = append(m.Reactions, Reaction{Emoji: emoji, UID: uid})
+	})
+}
+
+//RemoveReaction takes back the reaction of uid with the emoji, if there is one
+func RemoveReaction(c context.Context, tid int64, mid int64, uid int64, emoji string) (Message, error) {
+	return updateReactions(c, tid, mid, uid, func(m *Message) {
+		for i, r := range m.Reactions {
+			if r.Emoji == emoji && r.UID == uid {
+				m.Reactions = append(m.Reactions[:i], m.Reactions[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+//updateReactions applies fn in a single store update, so reactions made at
+//the same time by others are not lost
+func updateReactions(c context.Context, tid int64, mid int64, uid int64, fn func(*Message)) (Message, error) {
+	var m Message
+	err := store.UpdateMessage(c, tid, mid, func(nm *Message) error {
+		if nm.IsDeletedFor(uid) {
+			return ErrDeleted
+		}
+		fn(nm)
+		m = *nm
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	t, err := store.GetThread(c, tid)
+	if err != nil {
+		return m, err
+	}
+	if m, err = withQuote(c, m); err != nil {
+		return m, err
+	}
+	publish(c, ReactionsChanged{Thread: t, Message: m.VisibleTo(0), hiddenFor: m.HiddenFor})
+	return m, nil
+}
+
+//MarkRead moves the read marker of uid in the thread up to the message, it
+//never moves back to an earlier message. The returned marker is where it is
+//after the call. Markers are of the messages of the thread itself, so
+//reading a reply marks its root read
+func MarkRead(c context.Context, tid int64, mid int64, uid int64) (ReadMarker, error) {
+	m, err := store.GetMessage(c, tid, mid)
+	if err == nil && m.Root != 0 {
+		m, err = store.GetMessage(c, tid, m.Root)
+	}
+	if err != nil {
+		return ReadMarker{}, err
+	}
+
+	var r ReadMarker
+	var moved bool
+	var t Thread
+	err = store.UpdateThread(c, tid, func(nt *Thread) error {
+		if !nt.CheckIfParticipant(uid) {
+			return ErrNotParticipant
+		}
+
+		var ok bool
+		if r, ok = nt.ReadMarker(uid); ok && r.covers(m.Time, m.MessageID) {
+			moved = false
+		} else {
+			r, moved = ReadMarker{UID: uid, MessageID: m.MessageID, Time: m.Time}, true
+			nt.setReadMarker(r)
+		}
+		t = *nt
+		return nil
+	})
+	if err != nil || !moved {
+		return r, err
+	}
+
+	if err = updateUnread(c, tid, r); err != nil {
+		log.Print("Unread count update failed", err)
+	}
+
+	publish(c, MessagesRead{Thread: t, Marker: r})
+	return r, nil
+}
+
+//updateUnread recounts the messages after the read marker not sent by its
+//user, it is only done when the marker moves. Messages at the same Time as
+//the marker are after it if their id is higher
+func updateUnread(c context.Context, tid int64, r ReadMarker) error {
+	ms, err := store.QueryMessages(c, tid, Query{Since: r.Time})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, m := range ms {
+		if r.covers(m.Time, m.MessageID) {
+			continue
+		}
+		if m.From != r.UID && !m.IsDeletedFor(r.UID) {
+			n++
+		}
+	}
+
+	return store.UpdateAllThreads(c, r.UID, func(con *AllThreads) error {
+		con.setUnread(tid, n)
+		return nil
+	})
+}
+
+//MarkDelivered records that the messages of the thread got to a client of
+//uid, by moving their delivery marker up to the latest of them not sent by
+//uid. Replies are not tracked
+func MarkDelivered(c context.Context, tid int64, uid int64, ms ...Message) error {
+	var latest *ReadMarker
+	for _, m := range ms {
+		if m.From == uid || m.Root != 0 || m.ParentThread != tid {
+			continue
+		}
+		if latest == nil || !latest.before(m.Time, m.MessageID) {
+			latest = &ReadMarker{UID: uid, MessageID: m.MessageID, Time: m.Time}
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+
+	//Fetching messages is frequent, so check before writing anything
+	t, err := store.GetThread(c, tid)
+	if err != nil {
+		return err
+	}
+	if r, ok := findMarker(t.DeliveryMarkers, uid); ok && r.covers(latest.Time, latest.MessageID) {
+		return nil
+	}
+
+	return store.UpdateThread(c, tid, func(nt *Thread) error {
+		if !nt.CheckIfParticipant(uid) {
+			return ErrNotParticipant
+		}
+		r, ok := findMarker(nt.DeliveryMarkers, uid)
+		if !ok || !r.covers(latest.Time, latest.MessageID) {
+			nt.DeliveryMarkers = setMarker(nt.DeliveryMarkers, *latest)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+//ErrInvalidCursor is returned for a cursor not made by Inbox
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+//InboxEntry is a thread as listed in the inbox of a user
+type InboxEntry struct {
+	Thread Thread
+	//LastMessage is the latest message as the user sees it, nil if there is
+	//none
+	LastMessage *Message
+	Unread      int
+}
+
+//Inbox lists the threads of uid with the latest activity first, at most limit
+//of them after the cursor. The cursor is empty for the first page, else the
+//one returned with the page before, which is empty after the last page
+func Inbox(c context.Context, uid int64, cursor string, limit int) ([]InboxEntry, string, error) {
+	var after inboxPos
+	if cursor != "" {
+		var err error
+		if after, err = decodeCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	con, err := store.GetAllThreads(c, uid)
+	if err == ErrNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	ps := make([]inboxPos, 0, len(con.Threads))
+	for i, tid := range con.Threads {
+		p := inboxPos{tid: tid}
+		if i < len(con.Activity) {
+			p.activity = con.Activity[i]
+		}
+		if cursor == "" || after.before(p) {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].before(ps[j]) })
+
+	var next string
+	if limit > 0 && len(ps) > limit {
+		ps = ps[:limit]
+		next = encodeCursor(ps[limit-1])
+	}
+
+	es := make([]InboxEntry, 0, len(ps))
+	for _, p := range ps {
+		t, err := store.GetThread(c, p.tid)
+		if err != nil {
+			return nil, "", err
+		}
+		e := InboxEntry{Thread: t, Unread: con.UnreadIn(p.tid)}
+
+		if t.LastMessageID != 0 {
+			m, err := store.GetMessage(c, t.ThreadID, t.LastMessageID)
+			if err == nil {
+				m = m.VisibleTo(uid)
+				e.LastMessage = &m
+			} else if err != ErrNotFound {
+				return nil, "", err
+			}
+		}
+		es = append(es, e)
+	}
+	return es, next, nil
+}
+
+//inboxPos is where a thread is in the inbox, the latest activity first and
+//the newest thread first among those with the same
+type inboxPos struct {
+	activity string
+	tid      int64
+}
+
+func (p inboxPos) before(o inboxPos) bool {
+	if p.activity == o.activity {
+		return p.tid > o.tid
+	}
+	return p.activity > o.activity
+}
+
+func encodeCursor(p inboxPos) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(p.tid, 10) + "|" + p.activity))
+}
+
+func decodeCursor(s string) (inboxPos, error) {
+	var p inboxPos
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return p, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		return p, ErrInvalidCursor
+	}
+	if p.tid, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return p, ErrInvalidCursor
+	}
+	p.activity = parts[1]
+	return p, nil
+}
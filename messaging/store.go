@@ -0,0 +1,70 @@
+package messaging
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+//ErrNotFound is returned by a Store when the requested entity does not exist
+var ErrNotFound = errors.New("No such entity")
+
+//Query selects the messages of a thread returned by Store.QueryMessages
+type Query struct {
+	//After only matches messages with a Time strictly after it, if set
+	After string
+	//Since only matches messages with a Time at or after it, if set
+	Since string
+	//Limit is the maximum number of messages returned, 0 for no limit
+	Limit int
+	//Desc orders the messages newest first instead of oldest first
+	Desc bool
+}
+
+//Store is the storage backend for threads, messages, their replies and the
+//per-user thread index. Every function in this package reads and writes through it
+type Store interface {
+	//AllocateThreadID reserves an unused thread id
+	AllocateThreadID(c context.Context) (int64, error)
+	//PutThread saves the thread under t.ThreadID
+	PutThread(c context.Context, t Thread) error
+	//GetThread returns ErrNotFound if there is no such thread
+	GetThread(c context.Context, tid int64) (Thread, error)
+	//UpdateThread atomically applies fn to the thread, it returns ErrNotFound
+	//if there is no such thread
+	UpdateThread(c context.Context, tid int64, fn func(*Thread) error) error
+
+	//AllocateMessageID reserves an unused message id in the thread
+	AllocateMessageID(c context.Context, tid int64) (int64, error)
+	//PutMessage saves the message under m.ParentThread and m.MessageID
+	PutMessage(c context.Context, m Message) error
+	//GetMessage returns the message or reply of the thread, ErrNotFound if
+	//there is no such message in the thread
+	GetMessage(c context.Context, tid int64, mid int64) (Message, error)
+	//UpdateMessage atomically applies fn to the message or reply, it returns
+	//ErrNotFound if there is no such message in the thread
+	UpdateMessage(c context.Context, tid int64, mid int64, fn func(*Message) error) error
+	//QueryMessages returns the messages of the thread matching q, ordered by
+	//Time. Replies are not among them
+	QueryMessages(c context.Context, tid int64, q Query) ([]Message, error)
+
+	//PutReply saves the reply under m.ParentThread, m.Root and m.MessageID.
+	//The id is allocated with AllocateMessageID
+	PutReply(c context.Context, m Message) error
+	//QueryReplies returns the replies to the message matching q, ordered by Time
+	QueryReplies(c context.Context, tid int64, root int64, q Query) ([]Message, error)
+
+	//GetAllThreads returns ErrNotFound if the user is not in any thread
+	GetAllThreads(c context.Context, uid int64) (AllThreads, error)
+	//UpdateAllThreads atomically applies fn to the index of the user, fn is
+	//given an empty index with UserID set if the user has none yet
+	UpdateAllThreads(c context.Context, uid int64, fn func(*AllThreads) error) error
+}
+
+var store Store
+
+//SetStore sets the storage backend used by the package
+// NOTE: Has to be called before serving any requests
+func SetStore(s Store) {
+	store = s
+}
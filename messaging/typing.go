@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//TypingTTL is how long a typing signal lasts, clients send another one while
+//the user keeps typing
+const TypingTTL = 5 * time.Second
+
+//typingRepeat is how soon a signal that is still fresh is passed on again, so
+//a client sending one every keystroke does not flood everyone
+const typingRepeat = TypingTTL / 2
+
+//Typing is published by StartTyping. It is not stored anywhere, Expires is when
+//the others stop showing it unless another one comes
+type Typing struct {
+	Thread  Thread
+	UID     int64
+	Expires string
+}
+
+//Participants of the thread but the one typing
+func (e Typing) Participants() []int64 {
+	uids := make([]int64, 0, len(e.Thread.Participants))
+	for _, uid := range e.Thread.Participants {
+		if uid != e.UID {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+//typists keeps when the typing signal of each user in a thread was last
+//passed on, only in memory since it expires in seconds anyway. Expired
+//signals are swept at most once every TypingTTL
+var typists = struct {
+	sync.Mutex
+	threads   map[int64]map[int64]time.Time
+	lastSweep time.Time
+}{threads: map[int64]map[int64]time.Time{}}
+
+//StartTyping tells the other participants of t that uid is typing, until
+//TypingTTL passes. A signal repeated soon after the last one is not passed on
+//again, the returned expiry is then that of the earlier one
+func StartTyping(c context.Context, t Thread, uid int64) (expires string, err error) {
+	if !t.CheckIfParticipant(uid) {
+		return "", ErrNotParticipant
+	}
+
+	at := time.Now()
+	if last, fresh := touchTypist(t.ThreadID, uid, at); fresh {
+		return last.Add(TypingTTL).UTC().Format(time.RFC3339), nil
+	}
+
+	expires = at.Add(TypingTTL).UTC().Format(time.RFC3339)
+	publish(c, Typing{Thread: t, UID: uid, Expires: expires})
+	return expires, nil
+}
+
+//touchTypist records uid typing in the thread at the time given, unless the
+//last signal passed on is recent enough to still count, which is returned
+func touchTypist(tid int64, uid int64, at time.Time) (last time.Time, fresh bool) {
+	typists.Lock()
+	defer typists.Unlock()
+
+	if at.Sub(typists.lastSweep) >= TypingTTL {
+		sweepTypists(at)
+	}
+
+	users, ok := typists.threads[tid]
+	if !ok {
+		users = map[int64]time.Time{}
+		typists.threads[tid] = users
+	}
+	for u, t := range users {
+		if at.Sub(t) >= TypingTTL {
+			delete(users, u)
+		}
+	}
+
+	if last, ok := users[uid]; ok && at.Sub(last) < typingRepeat {
+		return last, true
+	}
+	users[uid] = at
+	return at, false
+}
+
+//sweepTypists drops the expired signals of every thread, and the threads
+//left without any
+func sweepTypists(at time.Time) {
+	for tid, users := range typists.threads {
+		for u, t := range users {
+			if at.Sub(t) >= TypingTTL {
+				delete(users, u)
+			}
+		}
+		if len(users) == 0 {
+			delete(typists.threads, tid)
+		}
+	}
+	typists.lastSweep = at
+}
+
+//stopTyping forgets the signal of uid, so typing right after sending a
+//message is passed on at once
+func stopTyping(tid int64, uid int64) {
+	typists.Lock()
+	defer typists.Unlock()
+
+	delete(typists.threads[tid], uid)
+	if len(typists.threads[tid]) == 0 {
+		delete(typists.threads, tid)
+	}
+}
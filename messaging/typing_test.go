@@ -0,0 +1,38 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingRepeat(t *testing.T) {
+	start := time.Now()
+	if _, fresh := touchTypist(1, 1, start); fresh {
+		t.Fatal("First signal not passed on")
+	}
+	if last, fresh := touchTypist(1, 1, start.Add(time.Second)); !fresh || !last.Equal(start) {
+		t.Error("Signal repeated right away passed on again")
+	}
+	if _, fresh := touchTypist(1, 1, start.Add(typingRepeat)); fresh {
+		t.Error("Signal repeated after typingRepeat not passed on")
+	}
+	stopTyping(1, 1)
+}
+
+func TestTypingExpires(t *testing.T) {
+	start := time.Now()
+	touchTypist(2, 1, start)
+	touchTypist(3, 1, start)
+
+	//Typing in another thread once they expired drops both threads
+	touchTypist(4, 1, start.Add(TypingTTL))
+
+	typists.Lock()
+	defer typists.Unlock()
+	for _, tid := range []int64{2, 3} {
+		if _, ok := typists.threads[tid]; ok {
+			t.Errorf("Thread %d kept after its signals expired", tid)
+		}
+	}
+	delete(typists.threads, 4)
+}
@@ -12,7 +12,15 @@ type Link struct {
 
 //AllThreads are all threads
 type AllThreads struct {
-	Threads []Link `json:"threads"`
+	Threads []ThreadSummary `json:"threads"`
+	//Unread is the number of unread messages in all threads
+	Unread int `json:"unread"`
+}
+
+//ThreadSummary links a thread in the list of threads of a user
+type ThreadSummary struct {
+	Link
+	Unread int `json:"unread"`
 }
 
 //Message Type for storing IMs
@@ -22,19 +30,163 @@ type Message struct {
 	From         Link   `json:"from"`
 	Content      string `json:"content"`
 	Time         string `json:"time"`
+	//Edited is when the content was last changed, if it was
+	Edited string `json:"edited,omitempty"`
+	//Deleted marks a tombstone, the content of a deleted message is gone
+	Deleted   bool       `json:"deleted,omitempty"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+	//ReplyTo links the message this one replies to, only its href is read
+	//from clients
+	ReplyTo *Quote `json:"replyTo,omitempty"`
+	//Root links the message this one is in the sub-thread of
+	Root *Link `json:"root,omitempty"`
+	//Replies summarises the sub-thread of the message, if it has one
+	Replies *Replies `json:"replies,omitempty"`
+	//Receipts is the status of the message for each recipient, only sent to
+	//its sender
+	Receipts []Receipt `json:"receipts,omitempty"`
+}
+
+//Receipt is the status of a message for one recipient, one of "sent",
+//"delivered" and "read"
+type Receipt struct {
+	User   Link   `json:"user"`
+	Status string `json:"status"`
+}
+
+//Replies links the sub-thread of a message
+type Replies struct {
+	Link
+	Count int    `json:"count"`
+	Last  string `json:"last"`
+}
+
+//Quote is a message replied to, with the start of its content
+type Quote struct {
+	Link
+	From    *Link  `json:"from,omitempty"`
+	Excerpt string `json:"excerpt,omitempty"`
+	Time    string `json:"time,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+//Inbox is a page of the threads of a user, the latest activity first
+type Inbox struct {
+	Threads []InboxThread `json:"threads"`
+	//Unread is the number of unread messages in all threads
+	Unread int `json:"unread"`
+	//Next is the cursor of the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+//InboxThread is a thread in the inbox with what is needed to list it
+type InboxThread struct {
+	Link
+	Participants []User `json:"participants"`
+	//LastMessage is the start of the latest message, if there is one
+	LastMessage  *Quote `json:"lastMessage,omitempty"`
+	LastActivity string `json:"lastActivity"`
+	Unread       int    `json:"unread"`
+}
+
+//Reaction is an emoji along with the users who reacted with it
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count,omitempty"`
+	Users []Link `json:"users,omitempty"`
+}
+
+//Revision is the content of a message before it was edited
+type Revision struct {
+	Content string `json:"content"`
+	Time    string `json:"time"`
 }
 
 //Thread represents a conversation
 type Thread struct {
 	Link
 	Participants []Link `json:"participants"`
+	//ReadBy has how far each participant who read anything has read
+	ReadBy []ReadMarker `json:"readBy,omitempty"`
+}
+
+//ReadMarker links the latest message a user has read
+type ReadMarker struct {
+	User    Link `json:"user"`
+	Message Link `json:"message"`
 }
 
 //User Defines a user
 type User struct {
 	Link
-	Name   string `json:"name"`
-	Secret string `json:"secret"`
+	Name string `json:"name"`
+	//Secret is only sent when a credential is issued
+	Secret string `json:"secret,omitempty"`
+	//Presence is left out if the user does not let it be seen
+	Presence *Presence `json:"presence,omitempty"`
+	//PresencePrivacy is who may see the presence, one of "everyone",
+	//"contacts" and "nobody". It is only sent to the user
+	PresencePrivacy string `json:"presencePrivacy,omitempty"`
+}
+
+//Presence is whether a user is "online", "away" or "offline" and when they
+//were last seen
+type Presence struct {
+	User     Link   `json:"user"`
+	Status   string `json:"status"`
+	LastSeen string `json:"lastSeen,omitempty"`
+}
+
+//Credential is an api secret of a user
+type Credential struct {
+	Link
+	Name    string `json:"name"`
+	Kind    string `json:"kind,omitempty"`
+	Created string `json:"created"`
+	Expires string `json:"expires,omitempty"`
+	//Secret is only sent when the credential is issued or rotated
+	Secret string `json:"secret,omitempty"`
+}
+
+//Session is the credential issued on login
+type Session struct {
+	Credential
+	User Link `json:"user"`
+	//Tokens are only sent if access tokens are enabled
+	*Tokens `json:",omitempty"`
+}
+
+//Tokens are an access token and the refresh token to renew it with
+type Tokens struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+//ParticipantChange lists the users added to a thread
+type ParticipantChange struct {
+	Thread Thread `json:"thread"`
+	Added  []Link `json:"added"`
+}
+
+//Typing tells a user is typing in a thread, until Expires unless another one
+//comes
+type Typing struct {
+	Thread  Link   `json:"thread"`
+	User    Link   `json:"user"`
+	Expires string `json:"expires"`
+}
+
+//Frame is a single update sent to or received from a live connection
+type Frame struct {
+	Type     string      `json:"type"`
+	Thread   *Link       `json:"thread,omitempty"`
+	Message  *Message    `json:"message,omitempty"`
+	Read     *ReadMarker `json:"read,omitempty"`
+	Typing   *Typing     `json:"typing,omitempty"`
+	Presence *Presence   `json:"presence,omitempty"`
+	Error    string      `json:"error,omitempty"`
 }
 
 //Response is a  struct
@@ -0,0 +1,325 @@
+//Package datastore is the Google Cloud Datastore storage backend, it is the
+//one used when deployed to App Engine
+package datastore
+
+import (
+	"golang.org/x/net/context"
+
+	gds "google.golang.org/appengine/datastore"
+
+	"github.com/abhicnv007/messenger-server/messaging"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//Store keeps Thread, Message, AllThreads and User entities in the Datastore.
+//Messages are stored as children of their Thread so they can be queried by
+//ancestor, and replies as Reply children of the Message they are replies to
+type Store struct{}
+
+//New returns a new Datastore backed store
+func New() *Store {
+	return &Store{}
+}
+
+func threadKey(c context.Context, tid int64) *gds.Key {
+	return gds.NewKey(c, "Thread", "", tid, nil)
+}
+
+func messageKey(c context.Context, tid int64, mid int64) *gds.Key {
+	return gds.NewKey(c, "Message", "", mid, threadKey(c, tid))
+}
+
+func replyKey(c context.Context, tid int64, root int64, mid int64) *gds.Key {
+	return gds.NewKey(c, "Reply", "", mid, messageKey(c, tid, root))
+}
+
+func allThreadsKey(c context.Context, uid int64) *gds.Key {
+	return gds.NewKey(c, "AllThreads", "", uid, nil)
+}
+
+func userKey(c context.Context, uid int64) *gds.Key {
+	return gds.NewKey(c, "User", "", uid, nil)
+}
+
+//get maps ErrNoSuchEntity to notFound
+func get(c context.Context, k *gds.Key, dst interface{}, notFound error) error {
+	err := gds.Get(c, k, dst)
+	if err == gds.ErrNoSuchEntity {
+		return notFound
+	}
+	return err
+}
+
+//AllocateThreadID implements messaging.Store
+func (s *Store) AllocateThreadID(c context.Context) (int64, error) {
+	l, _, err := gds.AllocateIDs(c, "Thread", nil, 1)
+	return l, err
+}
+
+//PutThread implements messaging.Store
+func (s *Store) PutThread(c context.Context, t messaging.Thread) error {
+	_, err := gds.Put(c, threadKey(c, t.ThreadID), &t)
+	return err
+}
+
+//GetThread implements messaging.Store
+func (s *Store) GetThread(c context.Context, tid int64) (messaging.Thread, error) {
+	var t messaging.Thread
+	err := get(c, threadKey(c, tid), &t, messaging.ErrNotFound)
+	return t, err
+}
+
+//UpdateThread implements messaging.Store
+func (s *Store) UpdateThread(c context.Context, tid int64, fn func(*messaging.Thread) error) error {
+	k := threadKey(c, tid)
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var t messaging.Thread
+		if err := get(tc, k, &t, messaging.ErrNotFound); err != nil {
+			return err
+		}
+		if err := fn(&t); err != nil {
+			return err
+		}
+		t.ThreadID = tid
+		_, err := gds.Put(tc, k, &t)
+		return err
+	}, nil)
+}
+
+//AllocateMessageID implements messaging.Store
+func (s *Store) AllocateMessageID(c context.Context, tid int64) (int64, error) {
+	l, _, err := gds.AllocateIDs(c, "Message", threadKey(c, tid), 1)
+	return l, err
+}
+
+//PutMessage implements messaging.Store
+func (s *Store) PutMessage(c context.Context, m messaging.Message) error {
+	_, err := gds.Put(c, messageKey(c, m.ParentThread, m.MessageID), &m)
+	return err
+}
+
+//getMessage loads the message or reply of the thread into m and returns its
+//key. The key of a reply has its root, which is not known here, so it is
+//looked up by its MessageID among the replies of the thread
+func getMessage(c context.Context, tid int64, mid int64, m *messaging.Message) (*gds.Key, error) {
+	k := messageKey(c, tid, mid)
+	if err := get(c, k, m, messaging.ErrNotFound); err != messaging.ErrNotFound {
+		return k, err
+	}
+
+	ks, err := gds.NewQuery("Reply").Ancestor(threadKey(c, tid)).
+		Filter("MessageID =", mid).KeysOnly().Limit(1).GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ks) == 0 {
+		return nil, messaging.ErrNotFound
+	}
+	return ks[0], get(c, ks[0], m, messaging.ErrNotFound)
+}
+
+//GetMessage implements messaging.Store
+func (s *Store) GetMessage(c context.Context, tid int64, mid int64) (messaging.Message, error) {
+	var m messaging.Message
+	_, err := getMessage(c, tid, mid, &m)
+	return m, err
+}
+
+//UpdateMessage implements messaging.Store
+func (s *Store) UpdateMessage(c context.Context, tid int64, mid int64, fn func(*messaging.Message) error) error {
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var m messaging.Message
+		k, err := getMessage(tc, tid, mid, &m)
+		if err != nil {
+			return err
+		}
+		if err := fn(&m); err != nil {
+			return err
+		}
+		m.ParentThread, m.MessageID = tid, mid
+		_, err = gds.Put(tc, k, &m)
+		return err
+	}, nil)
+}
+
+//QueryMessages implements messaging.Store, the queries need the Message/Time
+//indexes in app/index.yaml
+func (s *Store) QueryMessages(c context.Context, tid int64, q messaging.Query) ([]messaging.Message, error) {
+	return queryMessages(c, "Message", threadKey(c, tid), q)
+}
+
+//PutReply implements messaging.Store
+func (s *Store) PutReply(c context.Context, m messaging.Message) error {
+	_, err := gds.Put(c, replyKey(c, m.ParentThread, m.Root, m.MessageID), &m)
+	return err
+}
+
+//QueryReplies implements messaging.Store, the queries need the Reply/Time
+//indexes in app/index.yaml
+func (s *Store) QueryReplies(c context.Context, tid int64, root int64, q messaging.Query) ([]messaging.Message, error) {
+	return queryMessages(c, "Reply", messageKey(c, tid, root), q)
+}
+
+func queryMessages(c context.Context, kind string, ancestor *gds.Key, q messaging.Query) ([]messaging.Message, error) {
+	dq := gds.NewQuery(kind).Ancestor(ancestor)
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.After != "" {
+		dq = dq.Filter("Time >", q.After)
+	}
+	if q.Since != "" {
+		dq = dq.Filter("Time >=", q.Since)
+	}
+	if q.Desc {
+		dq = dq.Order("-Time")
+	} else {
+		dq = dq.Order("Time")
+	}
+
+	var m []messaging.Message
+	_, err := dq.GetAll(c, &m)
+	return m, err
+}
+
+//GetAllThreads implements messaging.Store
+func (s *Store) GetAllThreads(c context.Context, uid int64) (messaging.AllThreads, error) {
+	var con messaging.AllThreads
+	err := get(c, allThreadsKey(c, uid), &con, messaging.ErrNotFound)
+	return con, err
+}
+
+//UpdateAllThreads implements messaging.Store
+func (s *Store) UpdateAllThreads(c context.Context, uid int64, fn func(*messaging.AllThreads) error) error {
+	k := allThreadsKey(c, uid)
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var con messaging.AllThreads
+		if err := gds.Get(tc, k, &con); err == gds.ErrNoSuchEntity {
+			con = messaging.AllThreads{UserID: uid}
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(&con); err != nil {
+			return err
+		}
+
+		_, err := gds.Put(tc, k, &con)
+		return err
+	}, nil)
+}
+
+//AllocateUserID implements user.Store
+func (s *Store) AllocateUserID(c context.Context) (int64, error) {
+	l, _, err := gds.AllocateIDs(c, "User", nil, 1)
+	return l, err
+}
+
+//PutUser implements user.Store
+func (s *Store) PutUser(c context.Context, u user.User) error {
+	_, err := gds.Put(c, userKey(c, u.UID), &u)
+	return err
+}
+
+//GetUser implements user.Store
+func (s *Store) GetUser(c context.Context, uid int64) (user.User, error) {
+	var u user.User
+	err := get(c, userKey(c, uid), &u, user.ErrNotFound)
+	return u, err
+}
+
+//UpdateUser implements user.Store
+func (s *Store) UpdateUser(c context.Context, uid int64, fn func(*user.User) error) error {
+	k := userKey(c, uid)
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var u user.User
+		if err := get(tc, k, &u, user.ErrNotFound); err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+		u.UID = uid
+		_, err := gds.Put(tc, k, &u)
+		return err
+	}, nil)
+}
+
+//FindUsers implements user.Store
+func (s *Store) FindUsers(c context.Context, name string) ([]user.User, error) {
+	var u []user.User
+	_, err := gds.NewQuery("User").Filter("Name =", name).GetAll(c, &u)
+	return u, err
+}
+
+//ForEachUser implements user.Store
+func (s *Store) ForEachUser(c context.Context, fn func(user.User) error) error {
+	it := gds.NewQuery("User").Run(c)
+	for {
+		var u user.User
+		_, err := it.Next(&u)
+		if err == gds.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = fn(u); err != nil {
+			return err
+		}
+	}
+}
+
+//Credentials are children of their User, so they are strongly consistent when
+//queried by ancestor
+
+func credentialKey(c context.Context, uid int64, cid int64) *gds.Key {
+	return gds.NewKey(c, "Credential", "", cid, userKey(c, uid))
+}
+
+//AllocateCredentialID implements user.Store
+func (s *Store) AllocateCredentialID(c context.Context, uid int64) (int64, error) {
+	l, _, err := gds.AllocateIDs(c, "Credential", userKey(c, uid), 1)
+	return l, err
+}
+
+//PutCredential implements user.Store
+func (s *Store) PutCredential(c context.Context, cr user.Credential) error {
+	_, err := gds.Put(c, credentialKey(c, cr.UID, cr.CredentialID), &cr)
+	return err
+}
+
+//GetCredentials implements user.Store
+func (s *Store) GetCredentials(c context.Context, uid int64) ([]user.Credential, error) {
+	var crs []user.Credential
+	_, err := gds.NewQuery("Credential").Ancestor(userKey(c, uid)).GetAll(c, &crs)
+	return crs, err
+}
+
+//UpdateCredential implements user.Store
+func (s *Store) UpdateCredential(c context.Context, uid int64, cid int64, fn func(*user.Credential) error) error {
+	k := credentialKey(c, uid, cid)
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var cr user.Credential
+		if err := get(tc, k, &cr, user.ErrNotFound); err != nil {
+			return err
+		}
+		if err := fn(&cr); err != nil {
+			return err
+		}
+		cr.UID, cr.CredentialID = uid, cid
+		_, err := gds.Put(tc, k, &cr)
+		return err
+	}, nil)
+}
+
+//DeleteCredential implements user.Store
+func (s *Store) DeleteCredential(c context.Context, uid int64, cid int64) error {
+	k := credentialKey(c, uid, cid)
+	return gds.RunInTransaction(c, func(tc context.Context) error {
+		var cr user.Credential
+		if err := get(tc, k, &cr, user.ErrNotFound); err != nil {
+			return err
+		}
+		return gds.Delete(tc, k)
+	}, nil)
+}
@@ -0,0 +1,427 @@
+//Package memory is an in-memory storage backend meant for local development
+//and tests, nothing is persisted across restarts
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/messaging"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//Store keeps every entity in maps guarded by a single lock, it is safe for
+//concurrent use
+type Store struct {
+	mu sync.Mutex
+
+	//lastID is the last id handed out, ids are unique across all kinds just
+	//like the ones from datastore.AllocateIDs
+	lastID int64
+
+	threads     map[int64]messaging.Thread
+	messages    map[int64]map[int64]messaging.Message
+	replies     map[int64]map[int64]messaging.Message
+	allThreads  map[int64]messaging.AllThreads
+	users       map[int64]user.User
+	credentials map[int64]map[int64]user.Credential
+
+	//replyRoots has the root of every reply by its id
+	replyRoots map[int64]int64
+}
+
+//New returns a new empty store
+func New() *Store {
+	return &Store{
+		threads:     map[int64]messaging.Thread{},
+		messages:    map[int64]map[int64]messaging.Message{},
+		replies:     map[int64]map[int64]messaging.Message{},
+		replyRoots:  map[int64]int64{},
+		allThreads:  map[int64]messaging.AllThreads{},
+		users:       map[int64]user.User{},
+		credentials: map[int64]map[int64]user.Credential{},
+	}
+}
+
+func (s *Store) allocateID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+//The stored values must not share slices with the ones given to or returned
+//to callers, else a caller could change them without holding the lock
+
+func copyInt64s(a []int64) []int64 {
+	if a == nil {
+		return nil
+	}
+	return append([]int64{}, a...)
+}
+
+func copyThread(t messaging.Thread) messaging.Thread {
+	t.Participants = copyInt64s(t.Participants)
+	if t.ReadMarkers != nil {
+		t.ReadMarkers = append([]messaging.ReadMarker{}, t.ReadMarkers...)
+	}
+	if t.DeliveryMarkers != nil {
+		t.DeliveryMarkers = append([]messaging.ReadMarker{}, t.DeliveryMarkers...)
+	}
+	return t
+}
+
+func copyMessage(m messaging.Message) messaging.Message {
+	if m.Revisions != nil {
+		m.Revisions = append([]messaging.Revision{}, m.Revisions...)
+	}
+	m.HiddenFor = copyInt64s(m.HiddenFor)
+	m.Quoted = nil
+	if m.Reactions != nil {
+		m.Reactions = append([]messaging.Reaction{}, m.Reactions...)
+	}
+	return m
+}
+
+func copyAllThreads(con messaging.AllThreads) messaging.AllThreads {
+	con.Threads = copyInt64s(con.Threads)
+	if con.Unread != nil {
+		con.Unread = append([]int{}, con.Unread...)
+	}
+	if con.Activity != nil {
+		con.Activity = append([]string{}, con.Activity...)
+	}
+	return con
+}
+
+//AllocateThreadID implements messaging.Store
+func (s *Store) AllocateThreadID(c context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocateID(), nil
+}
+
+//PutThread implements messaging.Store
+func (s *Store) PutThread(c context.Context, t messaging.Thread) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.threads[t.ThreadID] = copyThread(t)
+	return nil
+}
+
+//GetThread implements messaging.Store
+func (s *Store) GetThread(c context.Context, tid int64) (messaging.Thread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.threads[tid]
+	if !ok {
+		return t, messaging.ErrNotFound
+	}
+	return copyThread(t), nil
+}
+
+//UpdateThread implements messaging.Store
+func (s *Store) UpdateThread(c context.Context, tid int64, fn func(*messaging.Thread) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.threads[tid]
+	if !ok {
+		return messaging.ErrNotFound
+	}
+	t = copyThread(t)
+	if err := fn(&t); err != nil {
+		return err
+	}
+	t.ThreadID = tid
+	s.threads[tid] = copyThread(t)
+	return nil
+}
+
+//AllocateMessageID implements messaging.Store
+func (s *Store) AllocateMessageID(c context.Context, tid int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocateID(), nil
+}
+
+//PutMessage implements messaging.Store
+func (s *Store) PutMessage(c context.Context, m messaging.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.messages[m.ParentThread]
+	if !ok {
+		ms = map[int64]messaging.Message{}
+		s.messages[m.ParentThread] = ms
+	}
+	ms[m.MessageID] = copyMessage(m)
+	return nil
+}
+
+//messagesOf returns the messages or replies the message mid of the thread
+//is kept in
+func (s *Store) messagesOf(tid int64, mid int64) (map[int64]messaging.Message, bool) {
+	if _, ok := s.messages[tid][mid]; ok {
+		return s.messages[tid], true
+	}
+	root, ok := s.replyRoots[mid]
+	if _, inThread := s.messages[tid][root]; !ok || !inThread {
+		return nil, false
+	}
+	return s.replies[root], true
+}
+
+//GetMessage implements messaging.Store
+func (s *Store) GetMessage(c context.Context, tid int64, mid int64) (messaging.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.messagesOf(tid, mid)
+	if !ok {
+		return messaging.Message{}, messaging.ErrNotFound
+	}
+	return copyMessage(ms[mid]), nil
+}
+
+//UpdateMessage implements messaging.Store
+func (s *Store) UpdateMessage(c context.Context, tid int64, mid int64, fn func(*messaging.Message) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, ok := s.messagesOf(tid, mid)
+	if !ok {
+		return messaging.ErrNotFound
+	}
+	m := copyMessage(ms[mid])
+	if err := fn(&m); err != nil {
+		return err
+	}
+	m.ParentThread, m.MessageID = tid, mid
+	ms[mid] = copyMessage(m)
+	return nil
+}
+
+//QueryMessages implements messaging.Store. Times are compared as strings,
+//the same way the Datastore compares them
+func (s *Store) QueryMessages(c context.Context, tid int64, q messaging.Query) ([]messaging.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return queryMessages(s.messages[tid], q), nil
+}
+
+//PutReply implements messaging.Store, replies are kept by the id of their
+//root message which is unique across threads
+func (s *Store) PutReply(c context.Context, m messaging.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.replies[m.Root]
+	if !ok {
+		rs = map[int64]messaging.Message{}
+		s.replies[m.Root] = rs
+	}
+	rs[m.MessageID] = copyMessage(m)
+	s.replyRoots[m.MessageID] = m.Root
+	return nil
+}
+
+//QueryReplies implements messaging.Store
+func (s *Store) QueryReplies(c context.Context, tid int64, root int64, q messaging.Query) ([]messaging.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[tid][root]; !ok {
+		return nil, nil
+	}
+	return queryMessages(s.replies[root], q), nil
+}
+
+func queryMessages(ms map[int64]messaging.Message, q messaging.Query) []messaging.Message {
+	var m []messaging.Message
+	for _, msg := range ms {
+		if q.After != "" && msg.Time <= q.After {
+			continue
+		}
+		if q.Since != "" && msg.Time < q.Since {
+			continue
+		}
+		m = append(m, copyMessage(msg))
+	}
+
+	sort.Slice(m, func(i, j int) bool {
+		if m[i].Time == m[j].Time {
+			return m[i].MessageID < m[j].MessageID
+		}
+		return m[i].Time < m[j].Time
+	})
+	if q.Desc {
+		for i, j := 0, len(m)-1; i < j; i, j = i+1, j-1 {
+			m[i], m[j] = m[j], m[i]
+		}
+	}
+
+	if q.Limit > 0 && len(m) > q.Limit {
+		m = m[:q.Limit]
+	}
+	return m
+}
+
+//GetAllThreads implements messaging.Store
+func (s *Store) GetAllThreads(c context.Context, uid int64) (messaging.AllThreads, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	con, ok := s.allThreads[uid]
+	if !ok {
+		return con, messaging.ErrNotFound
+	}
+	return copyAllThreads(con), nil
+}
+
+//UpdateAllThreads implements messaging.Store
+func (s *Store) UpdateAllThreads(c context.Context, uid int64, fn func(*messaging.AllThreads) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	con, ok := s.allThreads[uid]
+	if ok {
+		con = copyAllThreads(con)
+	} else {
+		con = messaging.AllThreads{UserID: uid}
+	}
+
+	if err := fn(&con); err != nil {
+		return err
+	}
+
+	s.allThreads[uid] = copyAllThreads(con)
+	return nil
+}
+
+//AllocateUserID implements user.Store
+func (s *Store) AllocateUserID(c context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocateID(), nil
+}
+
+//PutUser implements user.Store
+func (s *Store) PutUser(c context.Context, u user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.UID] = u
+	return nil
+}
+
+//GetUser implements user.Store
+func (s *Store) GetUser(c context.Context, uid int64) (user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[uid]
+	if !ok {
+		return u, user.ErrNotFound
+	}
+	return u, nil
+}
+
+//UpdateUser implements user.Store
+func (s *Store) UpdateUser(c context.Context, uid int64, fn func(*user.User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[uid]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if err := fn(&u); err != nil {
+		return err
+	}
+	u.UID = uid
+	s.users[uid] = u
+	return nil
+}
+
+//FindUsers implements user.Store
+func (s *Store) FindUsers(c context.Context, name string) ([]user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var u []user.User
+	for _, nu := range s.users {
+		if nu.Name == name {
+			u = append(u, nu)
+		}
+	}
+	return u, nil
+}
+
+//ForEachUser implements user.Store, fn is called without holding the lock so
+//it may use the store
+func (s *Store) ForEachUser(c context.Context, fn func(user.User) error) error {
+	s.mu.Lock()
+	us := make([]user.User, 0, len(s.users))
+	for _, u := range s.users {
+		us = append(us, u)
+	}
+	s.mu.Unlock()
+
+	for _, u := range us {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//AllocateCredentialID implements user.Store
+func (s *Store) AllocateCredentialID(c context.Context, uid int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocateID(), nil
+}
+
+//PutCredential implements user.Store
+func (s *Store) PutCredential(c context.Context, cr user.Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	crs, ok := s.credentials[cr.UID]
+	if !ok {
+		crs = map[int64]user.Credential{}
+		s.credentials[cr.UID] = crs
+	}
+	crs[cr.CredentialID] = cr
+	return nil
+}
+
+//GetCredentials implements user.Store
+func (s *Store) GetCredentials(c context.Context, uid int64) ([]user.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var crs []user.Credential
+	for _, cr := range s.credentials[uid] {
+		crs = append(crs, cr)
+	}
+	sort.Slice(crs, func(i, j int) bool {
+		return crs[i].CredentialID < crs[j].CredentialID
+	})
+	return crs, nil
+}
+
+//UpdateCredential implements user.Store
+func (s *Store) UpdateCredential(c context.Context, uid int64, cid int64, fn func(*user.Credential) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cr, ok := s.credentials[uid][cid]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if err := fn(&cr); err != nil {
+		return err
+	}
+	cr.UID, cr.CredentialID = uid, cid
+	s.credentials[uid][cid] = cr
+	return nil
+}
+
+//DeleteCredential implements user.Store
+func (s *Store) DeleteCredential(c context.Context, uid int64, cid int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.credentials[uid][cid]; !ok {
+		return user.ErrNotFound
+	}
+	delete(s.credentials[uid], cid)
+	return nil
+}
@@ -0,0 +1,178 @@
+package sqlite
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+)
+
+//migrations are applied in order, the schema version stored in the database
+//(PRAGMA user_version) is the number of migrations already applied.
+// NOTE: Never edit or reorder a migration once released, append a new one
+var migrations = []string{
+	//1: Initial schema, idx_messages_thread_time replaces the Message/Time
+	//indexes the Datastore needs in app/index.yaml
+	`CREATE TABLE id_sequence (
+		last_id INTEGER NOT NULL
+	);
+	INSERT INTO id_sequence (last_id) VALUES (0);
+
+	CREATE TABLE users (
+		uid        INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		password   TEXT NOT NULL,
+		secret_key TEXT NOT NULL
+	);
+	CREATE INDEX idx_users_name ON users (name);
+
+	CREATE TABLE threads (
+		thread_id INTEGER PRIMARY KEY
+	);
+
+	CREATE TABLE participants (
+		thread_id INTEGER NOT NULL REFERENCES threads (thread_id),
+		position  INTEGER NOT NULL,
+		uid       INTEGER NOT NULL,
+		PRIMARY KEY (thread_id, position)
+	);
+
+	CREATE TABLE messages (
+		message_id INTEGER PRIMARY KEY,
+		thread_id  INTEGER NOT NULL REFERENCES threads (thread_id),
+		from_uid   INTEGER NOT NULL,
+		content    TEXT NOT NULL,
+		time       TEXT NOT NULL
+	);
+	CREATE INDEX idx_messages_thread_time ON messages (thread_id, time);
+
+	CREATE TABLE user_threads (
+		uid       INTEGER NOT NULL,
+		position  INTEGER NOT NULL,
+		thread_id INTEGER NOT NULL,
+		PRIMARY KEY (uid, position)
+	);`,
+
+	//2: Hashed passwords, password only keeps legacy plaintext ones
+	`ALTER TABLE users ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+
+	//3: Hashed api secrets, one per device of a user
+	`CREATE TABLE credentials (
+		credential_id INTEGER PRIMARY KEY,
+		uid           INTEGER NOT NULL REFERENCES users (uid),
+		name          TEXT NOT NULL,
+		secret_hash   TEXT NOT NULL,
+		created       TEXT NOT NULL
+	);
+	CREATE INDEX idx_credentials_uid ON credentials (uid);`,
+
+	//4: Expiring credentials, for login sessions
+	`ALTER TABLE credentials ADD COLUMN expires TEXT NOT NULL DEFAULT '';`,
+
+	//5: Refresh tokens are credentials of their own kind
+	`ALTER TABLE credentials ADD COLUMN kind TEXT NOT NULL DEFAULT '';`,
+
+	//6: Edited messages keep their earlier contents
+	`ALTER TABLE messages ADD COLUMN edited TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE message_revisions (
+		message_id INTEGER NOT NULL REFERENCES messages (message_id),
+		position   INTEGER NOT NULL,
+		content    TEXT NOT NULL,
+		time       TEXT NOT NULL,
+		PRIMARY KEY (message_id, position)
+	);`,
+
+	//7: Messages deleted for everyone, or by some users for themselves
+	`ALTER TABLE messages ADD COLUMN deleted TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE message_hidden (
+		message_id INTEGER NOT NULL REFERENCES messages (message_id),
+		uid        INTEGER NOT NULL,
+		PRIMARY KEY (message_id, uid)
+	);`,
+
+	//8: Emoji reactions to messages
+	`CREATE TABLE message_reactions (
+		message_id INTEGER NOT NULL REFERENCES messages (message_id),
+		position   INTEGER NOT NULL,
+		emoji      TEXT NOT NULL,
+		uid        INTEGER NOT NULL,
+		PRIMARY KEY (message_id, position)
+	);`,
+
+	//9: Replies to an earlier message of the thread
+	`ALTER TABLE messages ADD COLUMN reply_to INTEGER NOT NULL DEFAULT 0;`,
+
+	//10: Sub-threads, replies are messages with the root they are replies to
+	`ALTER TABLE messages ADD COLUMN root_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN last_reply TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_messages_root_time ON messages (thread_id, root_id, time);`,
+
+	//11: How far each participant has read in a thread
+	`CREATE TABLE read_markers (
+		thread_id  INTEGER NOT NULL REFERENCES threads (thread_id),
+		uid        INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		time       TEXT NOT NULL,
+		PRIMARY KEY (thread_id, uid)
+	);`,
+
+	//12: Unread message counts of the threads of a user
+	`ALTER TABLE user_threads ADD COLUMN unread INTEGER NOT NULL DEFAULT 0;`,
+
+	//13: Latest activity of threads, for the inbox
+	`ALTER TABLE threads ADD COLUMN last_message_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE threads ADD COLUMN last_activity TEXT NOT NULL DEFAULT '';
+	ALTER TABLE user_threads ADD COLUMN activity TEXT NOT NULL DEFAULT '';`,
+
+	//14: The latest message each participant's clients got, like read_markers
+	`CREATE TABLE delivery_markers (
+		thread_id  INTEGER NOT NULL REFERENCES threads (thread_id),
+		uid        INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		time       TEXT NOT NULL,
+		PRIMARY KEY (thread_id, uid)
+	);`,
+
+	//15: When users were last seen online and who may see it
+	`ALTER TABLE users ADD COLUMN last_seen TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN presence_privacy TEXT NOT NULL DEFAULT '';`,
+
+	//16: The secret a refresh token was rotated from, to catch it being reused
+	`ALTER TABLE credentials ADD COLUMN previous_hash TEXT NOT NULL DEFAULT '';`,
+}
+
+//migrate brings the schema of db up to date, each migration runs in its own
+//transaction together with the version bump
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for version < len(migrations) {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		version++
+		//PRAGMA does not take bind parameters
+		if _, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Println("sqlite: migrated schema to version", version)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var v int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMigrateFromScratch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := schemaVersion(t, s.db); v != len(migrations) {
+		t.Errorf("Got schema version %d, want %d", v, len(migrations))
+	}
+	s.Close()
+
+	//Opening again has nothing left to migrate
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestMigrateKeepsData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	//A database of the first release, with a user from back then
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		migrations[0],
+		"INSERT INTO users (uid, name, password, secret_key) VALUES (7, 'old', 'pass', 'key')",
+		"PRAGMA user_version = 1",
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+	}
+	db.Close()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, err := s.GetUser(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := user.User{UID: 7, Name: "old", Password: "pass", SecretKey: "key"}
+	if u != want {
+		t.Errorf("Got %+v, want %+v", u, want)
+	}
+}
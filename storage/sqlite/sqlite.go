@@ -0,0 +1,677 @@
+//Package sqlite is a storage backend keeping everything in a single SQLite
+//file, meant for self hosting on a single machine
+package sqlite
+
+import (
+	"database/sql"
+
+	"golang.org/x/net/context"
+
+	//Registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/abhicnv007/messenger-server/messaging"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//Store keeps users, threads and messages in relational tables
+type Store struct {
+	db *sql.DB
+}
+
+//Open opens, or creates, the database file at path and migrates its schema
+//to the latest version
+func Open(path string) (*Store, error) {
+	//secure_delete overwrites deleted content, so purged messages do not
+	//linger in free pages of the file
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=1&_busy_timeout=5000&_secure_delete=1")
+	if err != nil {
+		return nil, err
+	}
+	//SQLite allows a single writer at a time, so serialise everything through
+	//one connection instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+//Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+//querier is either the database or a transaction
+type querier interface {
+	ExecContext(c context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(c context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(c context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//transact runs fn inside a transaction, committing if it returns nil
+func (s *Store) transact(c context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(c, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//allocateID hands out ids unique across all tables, like datastore.AllocateIDs
+func (s *Store) allocateID(c context.Context) (int64, error) {
+	var l int64
+	err := s.transact(c, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(c, "UPDATE id_sequence SET last_id = last_id + 1"); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(c, "SELECT last_id FROM id_sequence").Scan(&l)
+	})
+	return l, err
+}
+
+//AllocateThreadID implements messaging.Store
+func (s *Store) AllocateThreadID(c context.Context) (int64, error) {
+	return s.allocateID(c)
+}
+
+//PutThread implements messaging.Store
+func (s *Store) PutThread(c context.Context, t messaging.Thread) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		return putThread(c, tx, t)
+	})
+}
+
+func putThread(c context.Context, q querier, t messaging.Thread) error {
+	//Not replaced, that would break the foreign keys of its participants
+	if _, err := q.ExecContext(c, "INSERT OR IGNORE INTO threads (thread_id) VALUES (?)",
+		t.ThreadID); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(c, "UPDATE threads SET last_message_id = ?, last_activity = ? WHERE thread_id = ?",
+		t.LastMessageID, t.LastActivity, t.ThreadID); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(c, "DELETE FROM participants WHERE thread_id = ?",
+		t.ThreadID); err != nil {
+		return err
+	}
+	for i, p := range t.Participants {
+		if _, err := q.ExecContext(c, "INSERT INTO participants (thread_id, position, uid) VALUES (?, ?, ?)",
+			t.ThreadID, i, p); err != nil {
+			return err
+		}
+	}
+
+	if err := putMarkers(c, q, "read_markers", t.ThreadID, t.ReadMarkers); err != nil {
+		return err
+	}
+	return putMarkers(c, q, "delivery_markers", t.ThreadID, t.DeliveryMarkers)
+}
+
+//putMarkers replaces the markers of the thread in table, either read_markers
+//or delivery_markers
+func putMarkers(c context.Context, q querier, table string, tid int64, rs []messaging.ReadMarker) error {
+	if _, err := q.ExecContext(c, "DELETE FROM "+table+" WHERE thread_id = ?", tid); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		if _, err := q.ExecContext(c, "INSERT INTO "+table+
+			" (thread_id, uid, message_id, time) VALUES (?, ?, ?, ?)",
+			tid, r.UID, r.MessageID, r.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMarkers(c context.Context, q querier, table string, tid int64) ([]messaging.ReadMarker, error) {
+	rows, err := q.QueryContext(c, "SELECT uid, message_id, time FROM "+table+
+		" WHERE thread_id = ? ORDER BY uid", tid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []messaging.ReadMarker
+	for rows.Next() {
+		var r messaging.ReadMarker
+		if err = rows.Scan(&r.UID, &r.MessageID, &r.Time); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, rows.Err()
+}
+
+//GetThread implements messaging.Store
+func (s *Store) GetThread(c context.Context, tid int64) (messaging.Thread, error) {
+	return getThread(c, s.db, tid)
+}
+
+func getThread(c context.Context, q querier, tid int64) (messaging.Thread, error) {
+	t := messaging.Thread{ThreadID: tid}
+
+	err := q.QueryRowContext(c, "SELECT last_message_id, last_activity FROM threads WHERE thread_id = ?",
+		tid).Scan(&t.LastMessageID, &t.LastActivity)
+	if err == sql.ErrNoRows {
+		return t, messaging.ErrNotFound
+	} else if err != nil {
+		return t, err
+	}
+
+	t.Participants, err = int64s(c, q,
+		"SELECT uid FROM participants WHERE thread_id = ? ORDER BY position", tid)
+	if err != nil {
+		return t, err
+	}
+
+	if t.ReadMarkers, err = getMarkers(c, q, "read_markers", tid); err != nil {
+		return t, err
+	}
+	t.DeliveryMarkers, err = getMarkers(c, q, "delivery_markers", tid)
+	return t, err
+}
+
+//UpdateThread implements messaging.Store
+func (s *Store) UpdateThread(c context.Context, tid int64, fn func(*messaging.Thread) error) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		t, err := getThread(c, tx, tid)
+		if err != nil {
+			return err
+		}
+		if err = fn(&t); err != nil {
+			return err
+		}
+		t.ThreadID = tid
+		return putThread(c, tx, t)
+	})
+}
+
+//AllocateMessageID implements messaging.Store
+func (s *Store) AllocateMessageID(c context.Context, tid int64) (int64, error) {
+	return s.allocateID(c)
+}
+
+//PutMessage implements messaging.Store
+func (s *Store) PutMessage(c context.Context, m messaging.Message) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		return putMessage(c, tx, m)
+	})
+}
+
+func putMessage(c context.Context, q querier, m messaging.Message) error {
+	//The details go first, replacing the message would break their foreign keys
+	for _, table := range []string{"message_revisions", "message_hidden", "message_reactions"} {
+		if _, err := q.ExecContext(c, "DELETE FROM "+table+" WHERE message_id = ?",
+			m.MessageID); err != nil {
+			return err
+		}
+	}
+	if _, err := q.ExecContext(c, `INSERT OR REPLACE INTO messages
+		(message_id, thread_id, from_uid, content, time, edited, deleted, reply_to,
+		root_id, reply_count, last_reply) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.MessageID, m.ParentThread, m.From, m.Content, m.Time, m.Edited, m.Deleted,
+		m.ReplyTo, m.Root, m.ReplyCount, m.LastReply); err != nil {
+		return err
+	}
+	for i, r := range m.Revisions {
+		if _, err := q.ExecContext(c, `INSERT INTO message_revisions
+			(message_id, position, content, time) VALUES (?, ?, ?, ?)`,
+			m.MessageID, i, r.Content, r.Time); err != nil {
+			return err
+		}
+	}
+	for _, uid := range m.HiddenFor {
+		if _, err := q.ExecContext(c, "INSERT INTO message_hidden (message_id, uid) VALUES (?, ?)",
+			m.MessageID, uid); err != nil {
+			return err
+		}
+	}
+	for i, r := range m.Reactions {
+		if _, err := q.ExecContext(c, `INSERT INTO message_reactions
+			(message_id, position, emoji, uid) VALUES (?, ?, ?, ?)`,
+			m.MessageID, i, r.Emoji, r.UID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const messageColumns = "message_id, thread_id, from_uid, content, time, edited, deleted, reply_to, " +
+	"root_id, reply_count, last_reply"
+
+func scanMessage(row interface {
+	Scan(dest ...interface{}) error
+}) (messaging.Message, error) {
+	var m messaging.Message
+	err := row.Scan(&m.MessageID, &m.ParentThread, &m.From, &m.Content, &m.Time, &m.Edited, &m.Deleted,
+		&m.ReplyTo, &m.Root, &m.ReplyCount, &m.LastReply)
+	return m, err
+}
+
+//loadDetails fills in the revisions, hidden lists and reactions of the
+//messages. It must not be called while rows are still open, as there is a
+//single connection
+func loadDetails(c context.Context, q querier, ms []messaging.Message) error {
+	for i := range ms {
+		var err error
+		ms[i].HiddenFor, err = int64s(c, q,
+			"SELECT uid FROM message_hidden WHERE message_id = ?", ms[i].MessageID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := q.QueryContext(c, `SELECT content, time FROM message_revisions
+			WHERE message_id = ? ORDER BY position`, ms[i].MessageID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var r messaging.Revision
+			if err = rows.Scan(&r.Content, &r.Time); err != nil {
+				rows.Close()
+				return err
+			}
+			ms[i].Revisions = append(ms[i].Revisions, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = q.QueryContext(c, `SELECT emoji, uid FROM message_reactions
+			WHERE message_id = ? ORDER BY position`, ms[i].MessageID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var r messaging.Reaction
+			if err = rows.Scan(&r.Emoji, &r.UID); err != nil {
+				rows.Close()
+				return err
+			}
+			ms[i].Reactions = append(ms[i].Reactions, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetMessage implements messaging.Store
+func (s *Store) GetMessage(c context.Context, tid int64, mid int64) (messaging.Message, error) {
+	return getMessage(c, s.db, tid, mid)
+}
+
+func getMessage(c context.Context, q querier, tid int64, mid int64) (messaging.Message, error) {
+	m, err := scanMessage(q.QueryRowContext(c, "SELECT "+messageColumns+
+		" FROM messages WHERE thread_id = ? AND message_id = ?", tid, mid))
+	if err == sql.ErrNoRows {
+		return m, messaging.ErrNotFound
+	} else if err != nil {
+		return m, err
+	}
+
+	ms := []messaging.Message{m}
+	err = loadDetails(c, q, ms)
+	return ms[0], err
+}
+
+//UpdateMessage implements messaging.Store
+func (s *Store) UpdateMessage(c context.Context, tid int64, mid int64, fn func(*messaging.Message) error) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		m, err := getMessage(c, tx, tid, mid)
+		if err != nil {
+			return err
+		}
+		if err = fn(&m); err != nil {
+			return err
+		}
+		m.ParentThread, m.MessageID = tid, mid
+		return putMessage(c, tx, m)
+	})
+}
+
+//QueryMessages implements messaging.Store
+func (s *Store) QueryMessages(c context.Context, tid int64, q messaging.Query) ([]messaging.Message, error) {
+	return s.queryMessages(c, tid, 0, q)
+}
+
+//PutReply implements messaging.Store, replies are in the messages table with
+//the id of their root
+func (s *Store) PutReply(c context.Context, m messaging.Message) error {
+	return s.PutMessage(c, m)
+}
+
+//QueryReplies implements messaging.Store
+func (s *Store) QueryReplies(c context.Context, tid int64, root int64, q messaging.Query) ([]messaging.Message, error) {
+	return s.queryMessages(c, tid, root, q)
+}
+
+func (s *Store) queryMessages(c context.Context, tid int64, root int64, q messaging.Query) ([]messaging.Message, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE thread_id = ? AND root_id = ?"
+	args := []interface{}{tid, root}
+	if q.After != "" {
+		query += " AND time > ?"
+		args = append(args, q.After)
+	}
+	if q.Since != "" {
+		query += " AND time >= ?"
+		args = append(args, q.Since)
+	}
+	if q.Desc {
+		query += " ORDER BY time DESC, message_id DESC"
+	} else {
+		query += " ORDER BY time, message_id"
+	}
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(c, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []messaging.Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ms, loadDetails(c, s.db, ms)
+}
+
+//GetAllThreads implements messaging.Store
+func (s *Store) GetAllThreads(c context.Context, uid int64) (messaging.AllThreads, error) {
+	con, err := getAllThreads(c, s.db, uid)
+	if err == nil && len(con.Threads) == 0 {
+		return con, messaging.ErrNotFound
+	}
+	return con, err
+}
+
+func getAllThreads(c context.Context, q querier, uid int64) (messaging.AllThreads, error) {
+	con := messaging.AllThreads{UserID: uid}
+
+	rows, err := q.QueryContext(c, `SELECT thread_id, unread, activity FROM user_threads
+		WHERE uid = ? ORDER BY position`, uid)
+	if err != nil {
+		return con, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tid int64
+		var n int
+		var a string
+		if err = rows.Scan(&tid, &n, &a); err != nil {
+			return con, err
+		}
+		con.Threads = append(con.Threads, tid)
+		con.Unread = append(con.Unread, n)
+		con.Activity = append(con.Activity, a)
+	}
+	return con, rows.Err()
+}
+
+//UpdateAllThreads implements messaging.Store
+func (s *Store) UpdateAllThreads(c context.Context, uid int64, fn func(*messaging.AllThreads) error) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		con, err := getAllThreads(c, tx, uid)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(&con); err != nil {
+			return err
+		}
+
+		if _, err = tx.ExecContext(c, "DELETE FROM user_threads WHERE uid = ?", uid); err != nil {
+			return err
+		}
+		for i, tid := range con.Threads {
+			//Unread and Activity may be shorter than Threads
+			n, a := 0, ""
+			if i < len(con.Unread) {
+				n = con.Unread[i]
+			}
+			if i < len(con.Activity) {
+				a = con.Activity[i]
+			}
+			if _, err = tx.ExecContext(c, `INSERT INTO user_threads
+				(uid, position, thread_id, unread, activity) VALUES (?, ?, ?, ?, ?)`,
+				uid, i, tid, n, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//AllocateUserID implements user.Store
+func (s *Store) AllocateUserID(c context.Context) (int64, error) {
+	return s.allocateID(c)
+}
+
+//PutUser implements user.Store
+func (s *Store) PutUser(c context.Context, u user.User) error {
+	_, err := s.db.ExecContext(c, `INSERT OR REPLACE INTO users
+		(uid, name, password, password_hash, secret_key, last_seen, presence_privacy)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		u.UID, u.Name, u.Password, u.PasswordHash, u.SecretKey, u.LastSeen, u.PresencePrivacy)
+	return err
+}
+
+const userColumns = "uid, name, password, password_hash, secret_key, last_seen, presence_privacy"
+
+func scanUser(row interface {
+	Scan(dest ...interface{}) error
+}) (user.User, error) {
+	var u user.User
+	err := row.Scan(&u.UID, &u.Name, &u.Password, &u.PasswordHash, &u.SecretKey,
+		&u.LastSeen, &u.PresencePrivacy)
+	return u, err
+}
+
+//GetUser implements user.Store
+func (s *Store) GetUser(c context.Context, uid int64) (user.User, error) {
+	u, err := scanUser(s.db.QueryRowContext(c, "SELECT "+userColumns+
+		" FROM users WHERE uid = ?", uid))
+	if err == sql.ErrNoRows {
+		return u, user.ErrNotFound
+	}
+	return u, err
+}
+
+//UpdateUser implements user.Store, the row is updated in place rather than
+//replaced like PutUser does
+func (s *Store) UpdateUser(c context.Context, uid int64, fn func(*user.User) error) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		u, err := scanUser(tx.QueryRowContext(c, "SELECT "+userColumns+
+			" FROM users WHERE uid = ?", uid))
+		if err == sql.ErrNoRows {
+			return user.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err = fn(&u); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(c, `UPDATE users SET name = ?, password = ?, password_hash = ?,
+			secret_key = ?, last_seen = ?, presence_privacy = ? WHERE uid = ?`,
+			u.Name, u.Password, u.PasswordHash, u.SecretKey, u.LastSeen, u.PresencePrivacy, uid)
+		return err
+	})
+}
+
+//FindUsers implements user.Store
+func (s *Store) FindUsers(c context.Context, name string) ([]user.User, error) {
+	rows, err := s.db.QueryContext(c, "SELECT "+userColumns+
+		" FROM users WHERE name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var us []user.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, rows.Err()
+}
+
+//ForEachUser implements user.Store. The users are read up front, as the
+//single connection is held while rows are open and fn may use the store
+func (s *Store) ForEachUser(c context.Context, fn func(user.User) error) error {
+	rows, err := s.db.QueryContext(c, "SELECT "+userColumns+" FROM users ORDER BY uid")
+	if err != nil {
+		return err
+	}
+
+	var us []user.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		us = append(us, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range us {
+		if err = fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//AllocateCredentialID implements user.Store
+func (s *Store) AllocateCredentialID(c context.Context, uid int64) (int64, error) {
+	return s.allocateID(c)
+}
+
+//PutCredential implements user.Store
+func (s *Store) PutCredential(c context.Context, cr user.Credential) error {
+	return putCredential(c, s.db, cr)
+}
+
+func putCredential(c context.Context, q querier, cr user.Credential) error {
+	_, err := q.ExecContext(c, `INSERT OR REPLACE INTO credentials
+		(credential_id, uid, name, kind, secret_hash, previous_hash, created, expires)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		cr.CredentialID, cr.UID, cr.Name, cr.Kind, cr.SecretHash, cr.PreviousHash,
+		cr.Created, cr.Expires)
+	return err
+}
+
+const credentialColumns = "credential_id, uid, name, kind, secret_hash, previous_hash, created, expires"
+
+func scanCredential(row interface {
+	Scan(dest ...interface{}) error
+}) (user.Credential, error) {
+	var cr user.Credential
+	err := row.Scan(&cr.CredentialID, &cr.UID, &cr.Name, &cr.Kind, &cr.SecretHash,
+		&cr.PreviousHash, &cr.Created, &cr.Expires)
+	return cr, err
+}
+
+//GetCredentials implements user.Store
+func (s *Store) GetCredentials(c context.Context, uid int64) ([]user.Credential, error) {
+	rows, err := s.db.QueryContext(c, "SELECT "+credentialColumns+
+		" FROM credentials WHERE uid = ? ORDER BY credential_id", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var crs []user.Credential
+	for rows.Next() {
+		cr, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		crs = append(crs, cr)
+	}
+	return crs, rows.Err()
+}
+
+//UpdateCredential implements user.Store
+func (s *Store) UpdateCredential(c context.Context, uid int64, cid int64, fn func(*user.Credential) error) error {
+	return s.transact(c, func(tx *sql.Tx) error {
+		cr, err := scanCredential(tx.QueryRowContext(c, "SELECT "+credentialColumns+
+			" FROM credentials WHERE uid = ? AND credential_id = ?", uid, cid))
+		if err == sql.ErrNoRows {
+			return user.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err = fn(&cr); err != nil {
+			return err
+		}
+		cr.UID, cr.CredentialID = uid, cid
+		return putCredential(c, tx, cr)
+	})
+}
+
+//DeleteCredential implements user.Store
+func (s *Store) DeleteCredential(c context.Context, uid int64, cid int64) error {
+	res, err := s.db.ExecContext(c, "DELETE FROM credentials WHERE uid = ? AND credential_id = ?",
+		uid, cid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return user.ErrNotFound
+	}
+	return nil
+}
+
+//int64s returns the first column of every row of the query
+func int64s(c context.Context, q querier, query string, args ...interface{}) ([]int64, error) {
+	rows, err := q.QueryContext(c, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var l []int64
+	for rows.Next() {
+		var i int64
+		if err = rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		l = append(l, i)
+	}
+	return l, rows.Err()
+}
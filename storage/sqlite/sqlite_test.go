@@ -0,0 +1,229 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/messaging"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+func openTest(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestThreadRoundTrip(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+
+	tid, _ := s.AllocateThreadID(c)
+	th := messaging.Thread{
+		ThreadID:     tid,
+		Participants: []int64{1, 2},
+		ReadMarkers: []messaging.ReadMarker{
+			{UID: 1, MessageID: 10, Time: "2020-01-01T00:00:01Z"},
+		},
+		DeliveryMarkers: []messaging.ReadMarker{
+			{UID: 2, MessageID: 10, Time: "2020-01-01T00:00:01Z"},
+		},
+		LastMessageID: 10,
+		LastActivity:  "2020-01-01T00:00:01Z",
+	}
+	if err := s.PutThread(c, th); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetThread(c, tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, th) {
+		t.Errorf("Got %+v, want %+v", got, th)
+	}
+
+	if _, err = s.GetThread(c, tid+100); err != messaging.ErrNotFound {
+		t.Errorf("Got %v for a missing thread", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+
+	tid, _ := s.AllocateThreadID(c)
+	s.PutThread(c, messaging.Thread{ThreadID: tid, Participants: []int64{1, 2}})
+	mid, _ := s.AllocateMessageID(c, tid)
+	m := messaging.Message{
+		ParentThread: tid,
+		MessageID:    mid,
+		From:         1,
+		Content:      "edited",
+		Time:         "2020-01-01T00:00:01Z",
+		Edited:       "2020-01-01T00:00:02Z",
+		Revisions:    []messaging.Revision{{Content: "first", Time: "2020-01-01T00:00:01Z"}},
+		HiddenFor:    []int64{2},
+		Reactions:    []messaging.Reaction{{Emoji: "👍", UID: 1}},
+	}
+	if err := s.PutMessage(c, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetMessage(c, tid, mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Got %+v, want %+v", got, m)
+	}
+}
+
+func TestReplyLookup(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+
+	tid, _ := s.AllocateThreadID(c)
+	s.PutThread(c, messaging.Thread{ThreadID: tid, Participants: []int64{1, 2}})
+	root, _ := s.AllocateMessageID(c, tid)
+	s.PutMessage(c, messaging.Message{ParentThread: tid, MessageID: root, From: 1,
+		Content: "root", Time: "2020-01-01T00:00:01Z"})
+	mid, _ := s.AllocateMessageID(c, tid)
+	if err := s.PutReply(c, messaging.Message{ParentThread: tid, MessageID: mid, From: 2,
+		Content: "reply", Time: "2020-01-01T00:00:02Z", Root: root}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.UpdateMessage(c, tid, mid, func(m *messaging.Message) error {
+		m.Content = "edited"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetMessage(c, tid, mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "edited" || got.Root != root {
+		t.Errorf("Got reply %+v", got)
+	}
+
+	ms, err := s.QueryMessages(c, tid, messaging.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].MessageID != root {
+		t.Errorf("Got messages %+v, want only the root", ms)
+	}
+}
+
+func TestUpdateCredential(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+	if err := s.PutUser(c, user.User{UID: 7, Name: "seven"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := user.Credential{CredentialID: 1, UID: 7, Name: "phone", Kind: user.KindRefresh,
+		SecretHash: "new", PreviousHash: "old", Created: "2020-01-01T00:00:00Z"}
+	if err := s.PutCredential(c, cr); err != nil {
+		t.Fatal(err)
+	}
+	err := s.UpdateCredential(c, 7, 1, func(u *user.Credential) error {
+		if !reflect.DeepEqual(*u, cr) {
+			t.Errorf("Got %+v, want %+v", *u, cr)
+		}
+		u.SecretHash, u.PreviousHash = "newer", "new"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crs, err := s.GetCredentials(c, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crs) != 1 || crs[0].SecretHash != "newer" || crs[0].PreviousHash != "new" {
+		t.Errorf("Got %+v after the update", crs)
+	}
+
+	if err = s.UpdateCredential(c, 7, 2, func(*user.Credential) error { return nil }); err != user.ErrNotFound {
+		t.Errorf("Got %v updating a missing credential, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+	u := user.User{UID: 7, Name: "seven", PasswordHash: "hash"}
+	if err := s.PutUser(c, u); err != nil {
+		t.Fatal(err)
+	}
+	//Updated in place, the credentials referring to the user are kept
+	s.PutCredential(c, user.Credential{CredentialID: 1, UID: 7, Name: "phone",
+		SecretHash: "h", Created: "2020-01-01T00:00:00Z"})
+
+	err := s.UpdateUser(c, 7, func(u *user.User) error {
+		u.LastSeen = "2020-01-01T00:00:00Z"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.LastSeen = "2020-01-01T00:00:00Z"
+	if got, err := s.GetUser(c, 7); err != nil || !reflect.DeepEqual(got, u) {
+		t.Errorf("Got %+v, %v, want %+v", got, err, u)
+	}
+	if crs, _ := s.GetCredentials(c, 7); len(crs) != 1 {
+		t.Errorf("Got credentials %+v after the update", crs)
+	}
+
+	if err = s.UpdateUser(c, 8, func(*user.User) error { return nil }); err != user.ErrNotFound {
+		t.Errorf("Got %v updating a missing user, want ErrNotFound", err)
+	}
+}
+
+func TestQueryMessages(t *testing.T) {
+	c := context.Background()
+	s := openTest(t)
+
+	tid, _ := s.AllocateThreadID(c)
+	s.PutThread(c, messaging.Thread{ThreadID: tid, Participants: []int64{1}})
+	var mids []int64
+	for _, at := range []string{"2020-01-01T00:00:01Z", "2020-01-01T00:00:02Z", "2020-01-01T00:00:02Z"} {
+		mid, _ := s.AllocateMessageID(c, tid)
+		s.PutMessage(c, messaging.Message{ParentThread: tid, MessageID: mid, From: 1, Time: at})
+		mids = append(mids, mid)
+	}
+
+	ids := func(ms []messaging.Message) []int64 {
+		var ids []int64
+		for _, m := range ms {
+			ids = append(ids, m.MessageID)
+		}
+		return ids
+	}
+	for _, tc := range []struct {
+		q    messaging.Query
+		want []int64
+	}{
+		{messaging.Query{}, mids},
+		{messaging.Query{After: "2020-01-01T00:00:01Z"}, mids[1:]},
+		{messaging.Query{Since: "2020-01-01T00:00:02Z"}, mids[1:]},
+		{messaging.Query{Desc: true, Limit: 2}, []int64{mids[2], mids[1]}},
+	} {
+		ms, err := s.QueryMessages(c, tid, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(ms); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"github.com/abhicnv007/messenger-server/messaging"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//Store is a storage backend for everything the server persists
+type Store interface {
+	messaging.Store
+	user.Store
+}
+
+//Use sets s as the storage backend of the messaging and user packages
+// NOTE: Has to be called before serving any requests
+func Use(s Store) {
+	messaging.SetStore(s)
+	user.SetStore(s)
+}
@@ -0,0 +1,145 @@
+//Package token signs and verifies the short lived access tokens clients send
+//as "Authorization: Bearer", they are JWTs signed with HMAC-SHA256
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//Claims carried by an access token
+type Claims struct {
+	//UID is the user the token was issued to
+	UID int64 `json:"uid"`
+	//CredentialID is the refresh credential the token was issued from
+	CredentialID int64 `json:"cid"`
+	//IssuedAt and Expires are unix times in seconds
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+}
+
+//Key is a named HMAC key, the id is sent in the kid header of the tokens it
+//signs so the key to verify them with can be found after rotating keys
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+//Keyring holds the keys tokens are signed and verified with, it is safe for
+//concurrent use as it is never changed after being made
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+//Errors returned by Verify
+var (
+	ErrMalformed  = errors.New("Malformed token")
+	ErrUnknownKey = errors.New("Token signed with an unknown key")
+	ErrSignature  = errors.New("Invalid token signature")
+	ErrExpired    = errors.New("Token expired")
+)
+
+//NewKeyring returns a keyring signing with the first key, the others are
+//only used to verify tokens signed before the keys were rotated
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No token keys given")
+	}
+
+	k := &Keyring{current: keys[0].ID, keys: map[string][]byte{}}
+	for _, key := range keys {
+		if key.ID == "" || len(key.Secret) < 32 {
+			return nil, errors.New("Token keys need an id and at least 32 bytes of secret")
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, errors.New("Duplicate token key id " + key.ID)
+		}
+		k.keys[key.ID] = key.Secret
+	}
+	return k, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var enc = base64.RawURLEncoding
+
+func sign(key []byte, signed string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(signed))
+	return m.Sum(nil)
+}
+
+//Sign returns the claims as a token signed with the current key
+func (k *Keyring) Sign(cl Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT", Kid: k.current})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(cl)
+	if err != nil {
+		return "", err
+	}
+
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(p)
+	return signed + "." + enc.EncodeToString(sign(k.keys[k.current], signed)), nil
+}
+
+//Verify checks the signature of the token and that it has not expired at
+//now, and returns its claims
+func (k *Keyring) Verify(tok string, now time.Time) (Claims, error) {
+	var cl Claims
+
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return cl, ErrMalformed
+	}
+
+	hb, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return cl, ErrMalformed
+	}
+	var h header
+	if err = json.Unmarshal(hb, &h); err != nil {
+		return cl, ErrMalformed
+	}
+	//Only ever accept the algorithm tokens are signed with, never "none"
+	if h.Alg != "HS256" {
+		return cl, ErrMalformed
+	}
+
+	key, ok := k.keys[h.Kid]
+	if !ok {
+		return cl, ErrUnknownKey
+	}
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return cl, ErrMalformed
+	}
+	if !hmac.Equal(sig, sign(key, parts[0]+"."+parts[1])) {
+		return cl, ErrSignature
+	}
+
+	pb, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return cl, ErrMalformed
+	}
+	if err = json.Unmarshal(pb, &cl); err != nil {
+		return cl, ErrMalformed
+	}
+
+	if now.Unix() >= cl.Expires {
+		return cl, ErrExpired
+	}
+	return cl, nil
+}
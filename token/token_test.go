@@ -0,0 +1,71 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(id string) Key {
+	return Key{ID: id, Secret: []byte(strings.Repeat(id, 32))}
+}
+
+func TestSignVerify(t *testing.T) {
+	k, err := NewKeyring(testKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cl := Claims{UID: 1, CredentialID: 2, IssuedAt: now.Unix(), Expires: now.Add(time.Minute).Unix()}
+	tok, err := k.Sign(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := k.Verify(tok, now)
+	if err != nil || got != cl {
+		t.Fatalf("Got %+v %v, want %+v", got, err, cl)
+	}
+
+	if _, err = k.Verify(tok, now.Add(time.Minute)); err != ErrExpired {
+		t.Errorf("Got %v verifying an expired token", err)
+	}
+
+	parts := strings.Split(tok, ".")
+	forged, _ := k.Sign(Claims{UID: 3, Expires: cl.Expires})
+	if _, err = k.Verify(parts[0]+"."+strings.Split(forged, ".")[1]+"."+parts[2], now); err != ErrSignature {
+		t.Errorf("Got %v verifying a token with swapped claims", err)
+	}
+	if _, err = k.Verify("abc", now); err != ErrMalformed {
+		t.Errorf("Got %v verifying garbage", err)
+	}
+}
+
+func TestVerifyRejectsNone(t *testing.T) {
+	k, _ := NewKeyring(testKey("a"))
+	none := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"a"}`)) + "." +
+		enc.EncodeToString([]byte(`{"uid":1,"exp":9999999999}`)) + "."
+	if _, err := k.Verify(none, time.Now()); err != ErrMalformed {
+		t.Errorf("Got %v verifying an unsigned token", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, _ := NewKeyring(testKey("a"))
+	rotated, _ := NewKeyring(testKey("b"), testKey("a"))
+	other, _ := NewKeyring(testKey("c"))
+
+	cl := Claims{UID: 1, Expires: time.Now().Add(time.Minute).Unix()}
+	tok, _ := old.Sign(cl)
+	if _, err := rotated.Verify(tok, time.Now()); err != nil {
+		t.Errorf("Token of the previous key rejected after rotating: %v", err)
+	}
+	if _, err := other.Verify(tok, time.Now()); err != ErrUnknownKey {
+		t.Errorf("Got %v verifying with an unknown key", err)
+	}
+
+	if _, err := NewKeyring(Key{ID: "short", Secret: []byte("x")}); err == nil {
+		t.Error("Short key accepted")
+	}
+}
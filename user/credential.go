@@ -0,0 +1,359 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//Credential is an api secret of a user, a user has one per device. Only the
+//hash of the secret is stored, the secret itself is handed out once when the
+//credential is issued or rotated
+type Credential struct {
+	CredentialID int64  `json:"credentialid"`
+	UID          int64  `json:"uid"`
+	Name         string `json:"name"`
+	Kind         string `json:"kind"`
+	SecretHash   string `json:"-"`
+	//PreviousHash is the hash of the secret a refresh token was last rotated
+	//from, that token being used again means it was stolen
+	PreviousHash string `json:"-"`
+	//Created is when the current secret was made, in RFC3339
+	Created string `json:"created"`
+	//Expires is when the credential stops working, in RFC3339. It never
+	//expires if empty
+	Expires string `json:"expires"`
+}
+
+//Expired reports whether the credential has expired at t
+func (cr *Credential) Expired(t time.Time) bool {
+	if cr.Expires == "" {
+		return false
+	}
+	e, err := time.Parse(time.RFC3339, cr.Expires)
+	return err != nil || !t.Before(e)
+}
+
+//Kinds of credentials
+const (
+	//KindSecret is an api secret sent with Basic auth, stored ones from before
+	//kinds existed have an empty Kind and are secrets too
+	KindSecret = ""
+	//KindRefresh is a refresh token, only good for getting access tokens
+	KindRefresh = "refresh"
+)
+
+//legacyCredentialName is the name the SecretKey of users from before
+//credentials existed is moved to
+const legacyCredentialName = "default"
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// GenerateRandomString generates random strings of length 64 [a-zA-Z0-9]
+// from crypto/rand
+func generateRandomString() (string, error) {
+	b := make([]byte, 64)
+	max := big.NewInt(int64(len(letterBytes)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letterBytes[n.Int64()]
+	}
+	return string(b), nil
+}
+
+//Secrets are long and random, so a plain SHA-256 is enough to keep them from
+//being usable if the store leaks
+func hashSecret(sec string) string {
+	h := sha256.Sum256([]byte(sec))
+	return hex.EncodeToString(h[:])
+}
+
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+//newSecret sets a new secret on the credential and returns it, the
+//credential expires after ttl unless ttl is 0
+func (cr *Credential) newSecret(ttl time.Duration) (string, error) {
+	sec, err := generateRandomString()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	cr.SecretHash = hashSecret(sec)
+	cr.PreviousHash = ""
+	cr.Created = now.Format(time.RFC3339)
+	cr.Expires = ""
+	if ttl != 0 {
+		cr.Expires = now.Add(ttl).Format(time.RFC3339)
+	}
+	return sec, nil
+}
+
+//ttl returns how long the credential was valid for when it was made
+func (cr *Credential) ttl() time.Duration {
+	if cr.Expires == "" {
+		return 0
+	}
+	c, err := time.Parse(time.RFC3339, cr.Created)
+	if err != nil {
+		return 0
+	}
+	e, err := time.Parse(time.RFC3339, cr.Expires)
+	if err != nil {
+		return 0
+	}
+	return e.Sub(c)
+}
+
+//IssueCredential creates an api secret with the given name for the user and
+//returns it with its secret, it expires after ttl unless ttl is 0. An
+//existing secret with the same name is replaced, so a device logging in
+//again does not pile up credentials
+func IssueCredential(c context.Context, uid int64, name string, ttl time.Duration) (Credential, string, error) {
+	return issue(c, uid, name, KindSecret, ttl)
+}
+
+func issue(c context.Context, uid int64, name string, kind string, ttl time.Duration) (Credential, string, error) {
+	if name == "" {
+		return Credential{}, "", errors.New("Credential name is empty")
+	}
+
+	crs, err := store.GetCredentials(c, uid)
+	if err != nil {
+		return Credential{}, "", err
+	}
+
+	cr := Credential{UID: uid, Name: name, Kind: kind}
+	for _, old := range crs {
+		if old.Name == name && old.Kind == kind {
+			cr.CredentialID = old.CredentialID
+		}
+	}
+	if cr.CredentialID == 0 {
+		if cr.CredentialID, err = store.AllocateCredentialID(c, uid); err != nil {
+			return Credential{}, "", err
+		}
+	}
+
+	sec, err := cr.newSecret(ttl)
+	if err != nil {
+		return Credential{}, "", err
+	}
+	if err = store.PutCredential(c, cr); err != nil {
+		return Credential{}, "", err
+	}
+	return cr, sec, nil
+}
+
+//ListCredentials returns all credentials of the user
+func ListCredentials(c context.Context, uid int64) ([]Credential, error) {
+	return store.GetCredentials(c, uid)
+}
+
+//ErrRefreshCredential is returned for rotating a refresh credential, those are
+//only rotated by exchanging their token
+var ErrRefreshCredential = errors.New("Refresh credentials cannot be rotated")
+
+//RotateCredential replaces the secret of the credential, the old secret stops
+//working right away. A credential that expires gets as long as it was
+//originally issued for, starting now
+func RotateCredential(c context.Context, uid int64, cid int64) (Credential, string, error) {
+	var cr Credential
+	var sec string
+	err := store.UpdateCredential(c, uid, cid, func(ucr *Credential) error {
+		if ucr.Kind == KindRefresh {
+			return ErrRefreshCredential
+		}
+		var err error
+		if sec, err = ucr.newSecret(ucr.ttl()); err != nil {
+			return err
+		}
+		cr = *ucr
+		return nil
+	})
+	if err != nil {
+		return Credential{}, "", err
+	}
+	return cr, sec, nil
+}
+
+//IssueRefreshToken creates a refresh credential for the device of the user,
+//replacing any earlier one, and returns it with the refresh token
+func IssueRefreshToken(c context.Context, uid int64, name string, ttl time.Duration) (Credential, string, error) {
+	cr, sec, err := issue(c, uid, name, KindRefresh, ttl)
+	if err != nil {
+		return cr, "", err
+	}
+	return cr, refreshToken(uid, sec), nil
+}
+
+//ErrTokenReused is returned for a refresh token that was already exchanged.
+//Either it was stolen or the exchange raced with another one, so the
+//credential is revoked and the device has to log in again
+var ErrTokenReused = errors.New("Refresh token reused, log in again")
+
+//ExchangeRefreshToken checks the refresh token and rotates it, the token can
+//only be used once. It returns the refresh credential and the new token
+func ExchangeRefreshToken(c context.Context, tok string) (Credential, string, error) {
+	uid, sec, err := parseRefreshToken(tok)
+	if err != nil {
+		return Credential{}, "", err
+	}
+
+	crs, err := store.GetCredentials(c, uid)
+	if err != nil {
+		return Credential{}, "", err
+	}
+
+	h := hashSecret(sec)
+	for _, cr := range crs {
+		if cr.Kind != KindRefresh {
+			continue
+		}
+		if secretsEqual(cr.PreviousHash, h) {
+			return Credential{}, "", revokeReused(c, cr)
+		}
+		if !secretsEqual(cr.SecretHash, h) {
+			continue
+		}
+
+		//Checked again while rotating, so of two exchanges of the same
+		//token only one can succeed
+		var next string
+		err = store.UpdateCredential(c, uid, cr.CredentialID, func(ucr *Credential) error {
+			if secretsEqual(ucr.PreviousHash, h) {
+				return ErrTokenReused
+			} else if !secretsEqual(ucr.SecretHash, h) {
+				return ErrNotFound
+			}
+			if ucr.Expired(time.Now()) {
+				return errors.New("Refresh token expired")
+			}
+
+			//Rotating keeps the original expiry, so a session cannot be
+			//kept alive forever by refreshing
+			expires := ucr.Expires
+			sec, err := ucr.newSecret(0)
+			if err != nil {
+				return err
+			}
+			next = sec
+			ucr.Expires = expires
+			ucr.PreviousHash = h
+			cr = *ucr
+			return nil
+		})
+		if err == ErrTokenReused {
+			return Credential{}, "", revokeReused(c, cr)
+		} else if err == ErrNotFound {
+			//Revoked or rotated by something else in the meantime
+			break
+		} else if err != nil {
+			return Credential{}, "", err
+		}
+		return cr, refreshToken(uid, next), nil
+	}
+	return Credential{}, "", errors.New("Invalid refresh token")
+}
+
+//revokeReused deletes the refresh credential a reused token belongs to, with
+//every token rotated from it, and returns ErrTokenReused
+func revokeReused(c context.Context, cr Credential) error {
+	log.Println("Refresh token of credential", cr.CredentialID, "of", cr.UID, "reused, revoking it")
+	if err := store.DeleteCredential(c, cr.UID, cr.CredentialID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return ErrTokenReused
+}
+
+//A refresh token is "{uid}.{secret}", the uid is needed to find the hash
+func refreshToken(uid int64, sec string) string {
+	return strconv.FormatInt(uid, 10) + "." + sec
+}
+
+func parseRefreshToken(tok string) (int64, string, error) {
+	i := strings.Index(tok, ".")
+	if i < 0 {
+		return 0, "", errors.New("Invalid refresh token")
+	}
+	uid, err := strconv.ParseInt(tok[:i], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("Invalid refresh token")
+	}
+	return uid, tok[i+1:], nil
+}
+
+//RevokeCredential deletes the credential, its secret stops working right away
+func RevokeCredential(c context.Context, uid int64, cid int64) error {
+	return store.DeleteCredential(c, uid, cid)
+}
+
+//errSecretKeyMoved is returned to UpdateUser when the SecretKey was moved or
+//changed by another request meanwhile
+var errSecretKeyMoved = errors.New("Secret key moved meanwhile")
+
+//migrateSecretKey moves the plaintext SecretKey of the user to a hashed
+//credential, so its existing clients keep working. The credential is stored
+//before the SecretKey is cleared, so the secret works all along, and is
+//deleted again if another request moved the SecretKey first
+func migrateSecretKey(c context.Context, u User) (Credential, error) {
+	cid, err := store.AllocateCredentialID(c, u.UID)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	h := hashSecret(u.SecretKey)
+	cr := Credential{
+		CredentialID: cid,
+		UID:          u.UID,
+		Name:         legacyCredentialName,
+		SecretHash:   h,
+		Created:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if err = store.PutCredential(c, cr); err != nil {
+		return Credential{}, err
+	}
+
+	err = store.UpdateUser(c, u.UID, func(nu *User) error {
+		if !secretsEqual(nu.SecretKey, u.SecretKey) {
+			return errSecretKeyMoved
+		}
+		nu.SecretKey = ""
+		return nil
+	})
+	if err == nil {
+		return cr, nil
+	}
+
+	if err := store.DeleteCredential(c, u.UID, cid); err != nil && err != ErrNotFound {
+		log.Println("Could not delete the duplicate credential", cid, "of", u.UID, err)
+	}
+	if err != errSecretKeyMoved {
+		return Credential{}, err
+	}
+
+	//Use the credential the other request moved it to
+	crs, err := store.GetCredentials(c, u.UID)
+	if err != nil {
+		return Credential{}, err
+	}
+	for _, ocr := range crs {
+		if ocr.Kind == KindSecret && secretsEqual(ocr.SecretHash, h) {
+			return ocr, nil
+		}
+	}
+	return Credential{}, errSecretKeyMoved
+}
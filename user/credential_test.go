@@ -0,0 +1,153 @@
+package user_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/storage/memory"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+func TestLegacySecretKeyMigrates(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "old", SecretKey: "legacysecret"})
+
+	if _, _, err := user.IsValidSecret(c, 1, "wrong"); err == nil {
+		t.Fatal("Wrong secret accepted")
+	}
+
+	_, cr, err := user.IsValidSecret(c, 1, "legacysecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := s.GetUser(c, 1)
+	if u.SecretKey != "" {
+		t.Error("Plaintext secret key kept after moving it to a credential")
+	}
+	crs, _ := s.GetCredentials(c, 1)
+	if len(crs) != 1 || crs[0].CredentialID != cr.CredentialID || crs[0].SecretHash == "legacysecret" {
+		t.Fatalf("Got credentials %+v", crs)
+	}
+
+	//Clients keep using the same secret
+	if _, _, err = user.IsValidSecret(c, 1, "legacysecret"); err != nil {
+		t.Error(err)
+	}
+}
+
+//migratingStore lets another request move the SecretKey and change the
+//privacy of the user right after the credentials are first looked up
+type migratingStore struct {
+	*memory.Store
+	raced *bool
+}
+
+func (s migratingStore) GetCredentials(c context.Context, uid int64) ([]user.Credential, error) {
+	crs, err := s.Store.GetCredentials(c, uid)
+	if !*s.raced {
+		*s.raced = true
+		user.IsValidSecret(c, uid, "legacysecret")
+		s.Store.UpdateUser(c, uid, func(u *user.User) error {
+			u.PresencePrivacy = user.PrivacyNobody
+			return nil
+		})
+	}
+	return crs, err
+}
+
+func TestLegacySecretKeyMigratesOnce(t *testing.T) {
+	c := context.Background()
+	s := memory.New()
+	user.SetStore(migratingStore{s, new(bool)})
+	s.PutUser(c, user.User{UID: 1, Name: "old", SecretKey: "legacysecret"})
+
+	_, cr, err := user.IsValidSecret(c, 1, "legacysecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crs, _ := s.GetCredentials(c, 1)
+	if len(crs) != 1 || crs[0].CredentialID != cr.CredentialID {
+		t.Fatalf("Got credentials %+v, want only %+v", crs, cr)
+	}
+	u, _ := s.GetUser(c, 1)
+	if u.SecretKey != "" || u.PresencePrivacy != user.PrivacyNobody {
+		t.Errorf("Got %+v, want the secret key cleared and the privacy kept", u)
+	}
+}
+
+func TestRotateCredential(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "a"})
+
+	cr, old, err := user.IssueCredential(c, 1, "laptop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcr, sec, err := user.RotateCredential(c, 1, cr.CredentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcr.CredentialID != cr.CredentialID || rcr.Expires == "" {
+		t.Errorf("Got %+v after rotating %+v", rcr, cr)
+	}
+	if _, _, err = user.IsValidSecret(c, 1, old); err == nil {
+		t.Error("Old secret still works after rotating")
+	}
+	if _, _, err = user.IsValidSecret(c, 1, sec); err != nil {
+		t.Error(err)
+	}
+
+	//A revoked credential is not brought back
+	user.RevokeCredential(c, 1, cr.CredentialID)
+	if _, _, err = user.RotateCredential(c, 1, cr.CredentialID); err != user.ErrNotFound {
+		t.Errorf("Got %v rotating a revoked credential, want ErrNotFound", err)
+	}
+	if crs, _ := s.GetCredentials(c, 1); len(crs) != 0 {
+		t.Errorf("Got credentials %+v after revoking", crs)
+	}
+
+	rf, _, err := user.IssueRefreshToken(c, 1, "phone", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = user.RotateCredential(c, 1, rf.CredentialID); err != user.ErrRefreshCredential {
+		t.Errorf("Got %v rotating a refresh token, want ErrRefreshCredential", err)
+	}
+}
+
+func TestRotateCredentialConcurrently(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "a"})
+	cr, _, err := user.IssueCredential(c, 1, "laptop", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secs := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range secs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, secs[i], _ = user.RotateCredential(c, 1, cr.CredentialID)
+		}(i)
+	}
+	wg.Wait()
+
+	//Only the secret of the last rotation works
+	valid := 0
+	for _, sec := range secs {
+		if _, _, err := user.IsValidSecret(c, 1, sec); err == nil {
+			valid++
+		}
+	}
+	if valid != 1 {
+		t.Errorf("%d secrets valid after rotating concurrently, want 1", valid)
+	}
+}
@@ -0,0 +1,91 @@
+package user
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+)
+
+//passwordCost is the bcrypt cost new hashes are made with, hashes made with a
+//lower cost are upgraded the next time the user logs in
+const passwordCost = bcrypt.DefaultCost
+
+func hashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), passwordCost)
+	return string(h), err
+}
+
+//setPassword stores pass hashed, dropping any legacy plaintext password
+func (u *User) setPassword(pass string) error {
+	h, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = h
+	u.Password = ""
+	return nil
+}
+
+//checkPassword reports whether pass is the password of the user, and whether
+//the stored password should be rehashed as it is legacy plaintext or hashed
+//with an outdated cost
+func (u *User) checkPassword(pass string) (ok bool, rehash bool) {
+	if u.PasswordHash == "" {
+		return subtle.ConstantTimeCompare([]byte(u.Password), []byte(pass)) == 1, true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(pass)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(u.PasswordHash))
+	return true, err != nil || cost < passwordCost
+}
+
+//errPasswordChanged is returned to UpdateUser when the password was changed
+//since it was read, the change is then left alone
+var errPasswordChanged = errors.New("Password changed meanwhile")
+
+//storePassword replaces the password of old, as it was read, by the one of
+//upgraded. Only the password is written, and nothing is if it changed since
+func storePassword(c context.Context, old User, upgraded User) (User, error) {
+	var nu User
+	err := store.UpdateUser(c, old.UID, func(u *User) error {
+		if u.PasswordHash != old.PasswordHash || u.Password != old.Password {
+			return errPasswordChanged
+		}
+		u.PasswordHash, u.Password = upgraded.PasswordHash, upgraded.Password
+		nu = *u
+		return nil
+	})
+	return nu, err
+}
+
+//MigratePasswords hashes every legacy plaintext password in the store and
+//returns the number of users upgraded
+func MigratePasswords(c context.Context) (int, error) {
+	n := 0
+	err := store.ForEachUser(c, func(u User) error {
+		if u.PasswordHash != "" {
+			return nil
+		}
+		upgraded := u
+		if err := upgraded.setPassword(u.Password); err != nil {
+			return err
+		}
+		//Hashed by a login in the meantime
+		if _, err := storePassword(c, u, upgraded); err == errPasswordChanged {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		log.Println("Password migration stopped after", n, "users", err)
+	}
+	return n, err
+}
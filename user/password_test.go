@@ -0,0 +1,112 @@
+package user_test
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/storage/memory"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+func TestCheckRehashesWeakPassword(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+
+	weak, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PutUser(c, user.User{UID: 1, Name: "weak", PasswordHash: string(weak)})
+
+	if _, err = user.Check(c, "weak", "wrong"); err == nil {
+		t.Fatal("Wrong password accepted")
+	}
+	u, _ := s.GetUser(c, 1)
+	if u.PasswordHash != string(weak) {
+		t.Fatal("Rehashed on a wrong password")
+	}
+
+	if _, err = user.Check(c, "weak", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = s.GetUser(c, 1)
+	if cost, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("Got cost %d %v, want the password rehashed with %d", cost, err, bcrypt.DefaultCost)
+	}
+	if _, err = user.Check(c, "weak", "password"); err != nil {
+		t.Error("Rehashed password does not work", err)
+	}
+}
+
+func TestCheckHashesPlaintextPassword(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "legacy", Password: "password"})
+
+	if _, err := user.Check(c, "legacy", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := s.GetUser(c, 1)
+	if u.Password != "" || u.PasswordHash == "" {
+		t.Fatalf("Plaintext password kept: %+v", u)
+	}
+	if _, err := user.Check(c, "legacy", "password"); err != nil {
+		t.Error("Hashed password does not work", err)
+	}
+}
+
+func TestMigratePasswords(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "a", Password: "pa"})
+	s.PutUser(c, user.User{UID: 2, Name: "b", Password: "pb"})
+
+	if n, err := user.MigratePasswords(c); err != nil || n != 2 {
+		t.Fatalf("Migrated %d %v, want 2", n, err)
+	}
+	if n, err := user.MigratePasswords(c); err != nil || n != 0 {
+		t.Fatalf("Migrated %d %v again, want 0", n, err)
+	}
+	if _, err := user.Check(c, "b", "pb"); err != nil {
+		t.Error(err)
+	}
+}
+
+//racingStore changes the privacy of every user it finds right after, like a
+//request running at the same time as the one that found them
+type racingStore struct {
+	*memory.Store
+}
+
+func (s racingStore) FindUsers(c context.Context, name string) ([]user.User, error) {
+	us, err := s.Store.FindUsers(c, name)
+	for _, u := range us {
+		s.Store.UpdateUser(c, u.UID, func(u *user.User) error {
+			u.PresencePrivacy = user.PrivacyNobody
+			return nil
+		})
+	}
+	return us, err
+}
+
+func TestRehashKeepsOtherChanges(t *testing.T) {
+	c := context.Background()
+	s := memory.New()
+	user.SetStore(racingStore{s})
+	s.PutUser(c, user.User{UID: 1, Name: "legacy", Password: "password"})
+
+	if _, err := user.Check(c, "legacy", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := s.GetUser(c, 1)
+	if u.PasswordHash == "" || u.PresencePrivacy != user.PrivacyNobody {
+		t.Errorf("Got %+v, want the password hashed and the privacy kept", u)
+	}
+
+	//Already hashed, so there is nothing left to migrate
+	if n, err := user.MigratePasswords(c); err != nil || n != 0 {
+		t.Errorf("Migrated %d %v, want 0", n, err)
+	}
+}
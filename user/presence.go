@@ -0,0 +1,226 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//Presence statuses of a user
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+//Privacy settings for presence
+const (
+	//PrivacyEveryone lets any user see the presence
+	PrivacyEveryone = "everyone"
+	//PrivacyContacts lets only users sharing a thread see the presence
+	PrivacyContacts = "contacts"
+	//PrivacyNobody hides the presence from everyone else
+	PrivacyNobody = "nobody"
+)
+
+const (
+	//AwayAfter is how long after its last request a user without a live
+	//connection is away rather than online
+	AwayAfter = 2 * time.Minute
+	//OfflineAfter is how long after its last request a user without a live
+	//connection is offline
+	OfflineAfter = 10 * time.Minute
+	//lastSeenInterval is how often the last seen time of an active user is
+	//written to the store
+	lastSeenInterval = time.Minute
+)
+
+//ErrInvalidPrivacy is returned for a privacy setting that is not one of the
+//Privacy constants
+var ErrInvalidPrivacy = errors.New("Invalid privacy setting")
+
+//Presence is whether a user is around and when they last were
+type Presence struct {
+	UID    int64
+	Status string
+	//LastSeen is in RFC3339, empty if the user was never seen
+	LastSeen string
+}
+
+//presence is what this instance knows of a user being around, kept only in
+//memory. The store has LastSeen for the rest
+type presence struct {
+	seen time.Time
+	//conns is the number of open live connections
+	conns int
+	//left is set when the last live connection closed after the last request
+	left bool
+	//stored is when LastSeen was last written to the store
+	stored time.Time
+}
+
+func (p *presence) status(now time.Time) string {
+	switch {
+	case p.conns > 0:
+		return StatusOnline
+	case p.left:
+		return StatusOffline
+	}
+	return statusSince(p.seen, now)
+}
+
+func statusSince(seen time.Time, now time.Time) string {
+	switch d := now.Sub(seen); {
+	case d < AwayAfter:
+		return StatusOnline
+	case d < OfflineAfter:
+		return StatusAway
+	}
+	return StatusOffline
+}
+
+//tracker keeps the presence of the users seen by this instance. Users idle
+//for OfflineAfter are swept at most once every OfflineAfter, they are then
+//offline by their stored LastSeen too
+var tracker = struct {
+	sync.Mutex
+	users     map[int64]*presence
+	lastSweep time.Time
+}{users: map[int64]*presence{}}
+
+//sweepPresence drops the users without a live connection not seen for
+//OfflineAfter, it has to be called with the tracker locked
+func sweepPresence(now time.Time) {
+	if now.Sub(tracker.lastSweep) < OfflineAfter {
+		return
+	}
+	for uid, p := range tracker.users {
+		if p.conns == 0 && now.Sub(p.seen) >= OfflineAfter {
+			delete(tracker.users, uid)
+		}
+	}
+	tracker.lastSweep = now
+}
+
+//Seen records an authenticated request of the user. It returns the presence
+//after it, and whether the status changed so others can be told
+func Seen(c context.Context, uid int64) (Presence, bool) {
+	return track(c, uid, func(p *presence) {
+		p.left = false
+	})
+}
+
+//Connected records a live connection of the user being opened, it counts as
+//online until Disconnected is called for it
+func Connected(c context.Context, uid int64) (Presence, bool) {
+	return track(c, uid, func(p *presence) {
+		p.conns++
+		p.left = false
+	})
+}
+
+//Disconnected records a live connection of the user closing, the user is
+//offline once the last one is closed
+func Disconnected(c context.Context, uid int64) (Presence, bool) {
+	return track(c, uid, func(p *presence) {
+		if p.conns > 0 {
+			p.conns--
+		}
+		if p.conns == 0 {
+			p.left = true
+			//Going offline is always kept, it is the last seen time shown
+			p.stored = time.Time{}
+		}
+	})
+}
+
+func track(c context.Context, uid int64, fn func(p *presence)) (Presence, bool) {
+	now := time.Now()
+
+	tracker.Lock()
+	sweepPresence(now)
+	p, ok := tracker.users[uid]
+	if !ok {
+		p = &presence{}
+		tracker.users[uid] = p
+	}
+	before := p.status(now)
+	if !ok {
+		//Not seen by this instance yet, so it is not known to have been on
+		before = StatusOffline
+	}
+	p.seen = now
+	fn(p)
+	pr := Presence{UID: uid, Status: p.status(now), LastSeen: now.UTC().Format(time.RFC3339)}
+
+	store := now.Sub(p.stored) >= lastSeenInterval
+	if store {
+		p.stored = now
+	}
+	tracker.Unlock()
+
+	if store {
+		if err := storeLastSeen(c, uid, pr.LastSeen); err != nil {
+			log.Println("Could not store the last seen time of", uid, err)
+		}
+	}
+	return pr, pr.Status != before
+}
+
+//storeLastSeen changes only the LastSeen of the user, so it does not undo a
+//change to the rest made at the same time. It never moves back, another
+//instance may have stored a later time
+func storeLastSeen(c context.Context, uid int64, seen string) error {
+	return store.UpdateUser(c, uid, func(u *User) error {
+		if seen > u.LastSeen {
+			u.LastSeen = seen
+		}
+		return nil
+	})
+}
+
+//Privacy returns who may see the presence of the user, users stored before
+//there was a setting have PrivacyEveryone
+func (u User) Privacy() string {
+	if u.PresencePrivacy == "" {
+		return PrivacyEveryone
+	}
+	return u.PresencePrivacy
+}
+
+//GetPresence returns the presence of the user, u has to be the stored user
+//for its LastSeen. It does not check the privacy setting of the user
+func GetPresence(u User) Presence {
+	now := time.Now()
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	if p, ok := tracker.users[u.UID]; ok {
+		return Presence{UID: u.UID, Status: p.status(now),
+			LastSeen: p.seen.UTC().Format(time.RFC3339)}
+	}
+
+	//Another instance may have seen the user, so go by the stored time
+	pr := Presence{UID: u.UID, Status: StatusOffline, LastSeen: u.LastSeen}
+	if seen, err := time.Parse(time.RFC3339, u.LastSeen); err == nil {
+		pr.Status = statusSince(seen, now)
+	}
+	return pr
+}
+
+//SetPresencePrivacy sets who may see the presence of the user
+func SetPresencePrivacy(c context.Context, uid int64, privacy string) error {
+	switch privacy {
+	case PrivacyEveryone, PrivacyContacts, PrivacyNobody:
+	default:
+		return ErrInvalidPrivacy
+	}
+
+	return store.UpdateUser(c, uid, func(u *User) error {
+		u.PresencePrivacy = privacy
+		return nil
+	})
+}
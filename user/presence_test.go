@@ -0,0 +1,39 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepPresence(t *testing.T) {
+	now := time.Now()
+	tracker.Lock()
+	defer tracker.Unlock()
+	tracker.users[-1] = &presence{seen: now.Add(-OfflineAfter)}
+	tracker.users[-2] = &presence{seen: now.Add(-OfflineAfter), conns: 1}
+	tracker.users[-3] = &presence{seen: now.Add(-AwayAfter)}
+	tracker.lastSweep = time.Time{}
+
+	sweepPresence(now)
+	if _, ok := tracker.users[-1]; ok {
+		t.Error("Offline user kept")
+	}
+	if _, ok := tracker.users[-2]; !ok {
+		t.Error("Connected user dropped")
+	}
+	if _, ok := tracker.users[-3]; !ok {
+		t.Error("Away user dropped")
+	}
+
+	//Not swept again until OfflineAfter has passed
+	tracker.users[-3].seen = now.Add(-OfflineAfter)
+	sweepPresence(now.Add(time.Second))
+	if _, ok := tracker.users[-3]; !ok {
+		t.Error("Swept again right away")
+	}
+	sweepPresence(now.Add(OfflineAfter))
+	if _, ok := tracker.users[-3]; ok {
+		t.Error("Offline user kept on the next sweep")
+	}
+	delete(tracker.users, -2)
+}
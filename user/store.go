@@ -0,0 +1,49 @@
+package user
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+//ErrNotFound is returned by a Store when the requested user does not exist
+var ErrNotFound = errors.New("No such user")
+
+//Store is the storage backend for users. Every function in this package
+//reads and writes through it
+type Store interface {
+	//AllocateUserID reserves an unused uid
+	AllocateUserID(c context.Context) (int64, error)
+	//PutUser saves the user under u.UID
+	PutUser(c context.Context, u User) error
+	//GetUser returns ErrNotFound if there is no such user
+	GetUser(c context.Context, uid int64) (User, error)
+	//UpdateUser calls fn with the user and saves it unless fn returns an
+	//error, as one atomic step. It returns ErrNotFound if there is no such user
+	UpdateUser(c context.Context, uid int64, fn func(*User) error) error
+	//FindUsers returns all users with the given name
+	FindUsers(c context.Context, name string) ([]User, error)
+	//ForEachUser calls fn with every stored user, stopping at the first error
+	ForEachUser(c context.Context, fn func(User) error) error
+
+	//AllocateCredentialID reserves an unused credential id for the user
+	AllocateCredentialID(c context.Context, uid int64) (int64, error)
+	//PutCredential saves the credential under cr.UID and cr.CredentialID
+	PutCredential(c context.Context, cr Credential) error
+	//GetCredentials returns all credentials of the user
+	GetCredentials(c context.Context, uid int64) ([]Credential, error)
+	//UpdateCredential calls fn with the credential and saves it unless fn
+	//returns an error, as one atomic step. It returns ErrNotFound if the user
+	//has no such credential
+	UpdateCredential(c context.Context, uid int64, cid int64, fn func(*Credential) error) error
+	//DeleteCredential returns ErrNotFound if the user has no such credential
+	DeleteCredential(c context.Context, uid int64, cid int64) error
+}
+
+var store Store
+
+//SetStore sets the storage backend used by the package
+// NOTE: Has to be called before serving any requests
+func SetStore(s Store) {
+	store = s
+}
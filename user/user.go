@@ -2,63 +2,56 @@ package user
 
 import (
 	"log"
-	"math/rand"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"errors"
-
-	"google.golang.org/appengine/datastore"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-// GenerateRandomString generates random strings of length 64 [a-zA-Z0-9]
-func generateRandomString() string {
-	b := make([]byte, 64)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
-	}
-	return string(b)
-}
-
 //User Defines a user
 type User struct {
-	UID       int64  `json:"uid"`
-	Name      string `json:"name"`
-	Password  string `json:"password"`
-	SecretKey string
+	UID  int64  `json:"uid"`
+	Name string `json:"name"`
+	//Password is only set for users stored before passwords were hashed, it
+	//is the plaintext password and is cleared once it gets hashed
+	Password string `json:"-"`
+	//PasswordHash is the bcrypt hash of the password
+	PasswordHash string `json:"-"`
+	//SecretKey is only set for users stored before api secrets were kept as
+	//hashed credentials, it is moved to a credential on first use
+	SecretKey string `json:"-"`
+	//LastSeen is when the user was last known to be online, in RFC3339. It
+	//is only written every so often, see Seen
+	LastSeen string `json:"-"`
+	//PresencePrivacy is who may see the presence of the user, see Privacy
+	PresencePrivacy string `json:"-"`
 }
 
-//InsertNew inserts the given user into the database and returns it
+//InsertNew inserts the given user into the database and returns it, the
+//password is given in plaintext in u.Password and is stored hashed. The user
+//has no credentials yet, see IssueCredential
 func InsertNew(c context.Context, u User) (User, error) {
 
 	//[TODO] Make the username key
-	if c, err := datastore.NewQuery("User").Filter("Name =", u.Name).
-		Count(c); err != nil {
+	if us, err := store.FindUsers(c, u.Name); err != nil {
 		return u, err
-	} else if c != 0 {
+	} else if len(us) != 0 {
 		return u, errors.New("Username already exists")
 	}
 
-	l, _, err := datastore.AllocateIDs(c, "User", nil, 1)
+	l, err := store.AllocateUserID(c)
 
 	if err != nil {
 		log.Println(err)
 		return u, err
 	}
 
-	key := datastore.NewKey(c, "User", "", l, nil)
-
-	u.SecretKey = generateRandomString()
+	if err = u.setPassword(u.Password); err != nil {
+		return u, err
+	}
 	u.UID = l
-	_, err = datastore.Put(c, key, &u)
-	if err != nil {
+	if err = store.PutUser(c, u); err != nil {
 		log.Println(err)
 	}
 
@@ -68,46 +61,80 @@ func InsertNew(c context.Context, u User) (User, error) {
 
 //Check takes name and password
 func Check(c context.Context, name string, pass string) (User, error) {
-	var u []User
-	datastore.NewQuery("User").Filter("Name =", name).GetAll(c, &u)
+	u, _ := store.FindUsers(c, name)
 
 	if len(u) != 1 {
 		return User{}, errors.New("User does not exist")
 	}
-	if u[0].Password != pass {
+	ok, rehash := u[0].checkPassword(pass)
+	if !ok {
 		return User{}, errors.New("Username or password invalid")
 	}
+
+	if rehash {
+		//Failing to upgrade the stored password is no reason to fail the login
+		upgraded := u[0]
+		if err := upgraded.setPassword(pass); err != nil {
+			log.Println("Could not hash the password of", u[0].UID, err)
+		} else if nu, err := storePassword(c, u[0], upgraded); err == nil {
+			return nu, nil
+		} else if err != errPasswordChanged {
+			log.Println("Could not store the rehashed password of", u[0].UID, err)
+		}
+	}
 	return u[0], nil
 }
 
-//IsValidSecret checks if the user is valid, if is then send the uid
-func IsValidSecret(c context.Context, uid int64, sec string) (User, error) {
+//IsValidSecret checks if sec is the secret of one of the unexpired
+//credentials of the user, if is then sends the user and the matching
+//credential back
+func IsValidSecret(c context.Context, uid int64, sec string) (User, Credential, error) {
 
-	var nu User
-	k := datastore.NewKey(c, "User", "", uid, nil)
-	if err := datastore.Get(c, k, &nu); err != nil {
-		return User{}, errors.New("Invalid user")
+	nu, err := store.GetUser(c, uid)
+	if err != nil {
+		return User{}, Credential{}, errors.New("Invalid user")
 	}
 
-	//Compare all fields
-	if sec != nu.SecretKey {
-		return User{}, errors.New("Could not authenticate")
+	crs, err := store.GetCredentials(c, uid)
+	if err != nil {
+		return User{}, Credential{}, errors.New("Could not authenticate")
 	}
 
-	return nu, nil
+	h := hashSecret(sec)
+	for _, cr := range crs {
+		if cr.Kind != KindSecret || !secretsEqual(cr.SecretHash, h) {
+			continue
+		}
+		if cr.Expired(time.Now()) {
+			return User{}, Credential{}, errors.New("Credential expired")
+		}
+		return nu, cr, nil
+	}
+
+	if nu.SecretKey != "" && secretsEqual(nu.SecretKey, sec) {
+		cr, err := migrateSecretKey(c, nu)
+		if err != nil {
+			log.Println("Could not migrate the secret key of", uid, err)
+			return User{}, Credential{}, errors.New("Could not authenticate")
+		}
+		nu.SecretKey = ""
+		return nu, cr, nil
+	}
+
+	return User{}, Credential{}, errors.New("Could not authenticate")
 
 }
 
-//IsValidUser checks if the user is valid, if is then sends the user object back
+//IsValidUser checks if the user is valid, u.SecretKey being one of its api
+//secrets, if is then sends the user object back
 func IsValidUser(c context.Context, u User) (User, error) {
 
-	var nu User
-	k := datastore.NewKey(c, "User", "", u.UID, nil)
-	if err := datastore.Get(c, k, &nu); err != nil {
+	nu, _, err := IsValidSecret(c, u.UID, u.SecretKey)
+	if err != nil {
 		return User{}, errors.New("Invalid user")
 	}
 
-	if nu.Name != u.Name || nu.SecretKey != u.SecretKey {
+	if nu.Name != u.Name {
 		return User{}, errors.New("Incorrect user credentials")
 	}
 
@@ -117,9 +144,8 @@ func IsValidUser(c context.Context, u User) (User, error) {
 
 //Get gets the user details from the the uid
 func Get(c context.Context, uid int64) (User, error) {
-	var nu User
-	k := datastore.NewKey(c, "User", "", uid, nil)
-	if err := datastore.Get(c, k, &nu); err == datastore.ErrNoSuchEntity {
+	nu, err := store.GetUser(c, uid)
+	if err == ErrNotFound {
 		return User{}, errors.New("Invalid user")
 	} else if err != nil {
 		return User{}, errors.New("Could not fetch the details")
@@ -0,0 +1,130 @@
+package user_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/abhicnv007/messenger-server/storage/memory"
+	"github.com/abhicnv007/messenger-server/user"
+)
+
+//newStore sets a new memory backend and returns it to seed users directly
+func newStore() *memory.Store {
+	s := memory.New()
+	user.SetStore(s)
+	return s
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	c := context.Background()
+	newStore()
+
+	_, tok, err := user.IssueRefreshToken(c, 1, "phone", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, next, err := user.ExchangeRefreshToken(c, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == tok {
+		t.Fatal("Refresh token not rotated")
+	}
+	if _, _, err = user.ExchangeRefreshToken(c, next); err != nil {
+		t.Error("Rotated token does not work", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokes(t *testing.T) {
+	c := context.Background()
+	newStore()
+
+	_, tok, err := user.IssueRefreshToken(c, 1, "phone", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, next, err := user.ExchangeRefreshToken(c, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The old token used again, by whoever stole it or by the client
+	if _, _, err = user.ExchangeRefreshToken(c, tok); err != user.ErrTokenReused {
+		t.Fatalf("Got %v, want ErrTokenReused", err)
+	}
+	if _, _, err = user.ExchangeRefreshToken(c, next); err == nil {
+		t.Error("Token rotated from a reused one still works")
+	}
+}
+
+func TestRefreshTokenExchangedOnce(t *testing.T) {
+	c := context.Background()
+	newStore()
+
+	_, tok, err := user.IssueRefreshToken(c, 1, "phone", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	exchanged := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := user.ExchangeRefreshToken(c, tok); err == nil {
+				mu.Lock()
+				exchanged++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if exchanged > 1 {
+		t.Errorf("Token exchanged %d times", exchanged)
+	}
+}
+
+func TestSeenStoresOnlyLastSeen(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 1, Name: "u", PresencePrivacy: user.PrivacyNobody})
+	s.PutUser(c, user.User{UID: 2, Name: "later", LastSeen: "2999-01-01T00:00:00Z"})
+
+	pr, changed := user.Seen(c, 1)
+	if !changed || pr.Status != user.StatusOnline {
+		t.Errorf("Got %+v, changed %v, want online", pr, changed)
+	}
+	u, err := s.GetUser(c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.LastSeen != pr.LastSeen || u.PresencePrivacy != user.PrivacyNobody {
+		t.Errorf("Stored %+v", u)
+	}
+
+	//A later time stored by another instance is kept
+	user.Seen(c, 2)
+	if u, _ = s.GetUser(c, 2); u.LastSeen != "2999-01-01T00:00:00Z" {
+		t.Errorf("Last seen moved back to %s", u.LastSeen)
+	}
+}
+
+func TestDisconnectedGoesOffline(t *testing.T) {
+	c := context.Background()
+	s := newStore()
+	s.PutUser(c, user.User{UID: 3, Name: "u"})
+
+	user.Connected(c, 3)
+	user.Connected(c, 3)
+	if pr, changed := user.Disconnected(c, 3); changed || pr.Status != user.StatusOnline {
+		t.Errorf("Got %+v with a connection still open", pr)
+	}
+	if pr, changed := user.Disconnected(c, 3); !changed || pr.Status != user.StatusOffline {
+		t.Errorf("Got %+v after the last connection closed", pr)
+	}
+}